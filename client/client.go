@@ -0,0 +1,241 @@
+// client.go - embeddable SSProto client
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// Package client implements SSProto update client which can be embedded into
+// launchers and other applications. A Client connects to the update server
+// and returns a Session which brings installation directory in sync with the
+// server, reporting progress through events.
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// ErrVersionMismatch is returned by Connect when server speaks another
+// protocol version. Usually it means that client application needs an update.
+type ErrVersionMismatch struct {
+	Server uint8
+}
+
+func (e ErrVersionMismatch) Error() string {
+	return fmt.Sprintf("client: server protocol version %d, ours is %d", e.Server, ssproto.Version)
+}
+
+// ErrNoAddress is returned by New when no server address was configured.
+var ErrNoAddress = errors.New("client: no server address configured")
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAddress sets update server address.
+// Syntax: <host>:<port>
+func WithAddress(addr string) Option {
+	return func(c *Client) {
+		c.addr = addr
+	}
+}
+
+// WithTLSConfig sets TLS configuration used to connect to the server. If it
+// is not set, plain TCP is used.
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = conf
+	}
+}
+
+// WithDirectory sets installation directory that is kept in sync with the
+// server. Current directory is used by default.
+func WithDirectory(dir string) Option {
+	return func(c *Client) {
+		c.dir = dir
+	}
+}
+
+// WithEventHandler sets a function called for every session event. Handler
+// is called synchronously from the goroutine running the session.
+func WithEventHandler(h func(Event)) Option {
+	return func(c *Client) {
+		c.events = h
+	}
+}
+
+// WithExcluded replaces the list of regular expressions matching files and
+// directories that are not reported to the server. See DefaultExcluded.
+func WithExcluded(patterns []string) Option {
+	return func(c *Client) {
+		c.excluded = patterns
+	}
+}
+
+// WithHWInfo overrides machine information sent to the server. By default
+// JSON-encoded result of GetMachineInfo is sent.
+func WithHWInfo(info func() ([]byte, error)) Option {
+	return func(c *Client) {
+		c.hwinfo = info
+	}
+}
+
+// WithHashCache makes client take hashes of unchanged files from cache instead
+// of reading them. If cache file is located in installation directory, it is
+// not reported to the server.
+func WithHashCache(cache *hashcache.Cache) Option {
+	return func(c *Client) {
+		c.hashCache = cache
+	}
+}
+
+// WithCapabilities limits optional protocol features offered to the server.
+// By default every feature implemented by this package is offered.
+func WithCapabilities(caps ssproto.Capabilities) Option {
+	return func(c *Client) {
+		c.caps = caps & SupportedCapabilities
+	}
+}
+
+// SupportedCapabilities is a set of optional protocol features implemented
+// by this package.
+const SupportedCapabilities = ssproto.CapCompression | ssproto.CapDelta | ssproto.CapResume |
+	ssproto.CapMetadata | ssproto.CapManifest | ssproto.CapBatchVerdicts |
+	ssproto.CapManagedDirs | ssproto.CapChannels | ssproto.CapProfiles |
+	ssproto.CapQueue
+
+// Client holds configuration used to start update sessions.
+type Client struct {
+	addr      string
+	tlsConfig *tls.Config
+	dir       string
+	events    func(Event)
+	excluded  []string
+	hwinfo    func() ([]byte, error)
+	caps      ssproto.Capabilities
+	publicKey ed25519.PublicKey
+	hashCache *hashcache.Cache
+	retention time.Duration
+	history   int
+	channel   string
+	profile   string
+}
+
+// New creates a properly initialized Client object.
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		dir:       ".",
+		excluded:  DefaultExcluded,
+		hwinfo:    machineInfoJSON,
+		caps:      SupportedCapabilities,
+		retention: DefaultQuarantineRetention,
+		history:   DefaultHistoryLength,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.addr == "" {
+		return nil, ErrNoAddress
+	}
+	for _, name := range []string{c.channel, c.profile} {
+		if name != "" && ssproto.CheckName(name) != nil {
+			return nil, ssproto.ErrBadName
+		}
+	}
+	// Manifest is useless without a key to check it with.
+	if c.publicKey == nil {
+		c.caps &^= ssproto.CapManifest
+	}
+	return c, nil
+}
+
+func (c *Client) emit(ev Event) {
+	if c.events != nil {
+		c.events(ev)
+	}
+}
+
+// Connect dials the update server and checks protocol version. If versions
+// don't match, ErrVersionMismatch is returned. Servers talking legacy
+// protocol version are supported, but no optional features are used with them.
+func (c *Client) Connect() (*Session, error) {
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.Dial("tcp", c.addr, c.tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		client: c,
+		conn:   conn,
+		enc:    ssproto.NewEncoder(conn),
+		dec:    ssproto.NewDecoder(conn),
+
+		blockSizes: make(map[string]uint32),
+		hashes:     make(map[string]ssproto.Hash),
+		started:    time.Now(),
+	}
+
+	err = s.enc.WriteVersion(ssproto.Version)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	pv, err := s.dec.ReadVersion()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch pv {
+	case ssproto.Version:
+		err = s.enc.WriteCapabilities(c.caps)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		s.caps, err = s.dec.ReadCapabilities()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// Never trust server to stay within what we offered.
+		s.caps = s.caps.Intersect(c.caps)
+		s.enc.SetVersion(pv)
+		s.dec.SetVersion(pv)
+		s.enc.SetCapabilities(s.caps)
+		s.dec.SetCapabilities(s.caps)
+	case ssproto.VersionLegacy:
+	default:
+		conn.Close()
+		return nil, ErrVersionMismatch{pv}
+	}
+	if c.publicKey != nil && !s.caps.Has(ssproto.CapManifest) {
+		conn.Close()
+		return nil, ErrNoManifest
+	}
+	if err := s.sendRequests(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.version = pv
+	c.emit(Connected{ServerVersion: pv, Capabilities: s.caps})
+	return s, nil
+}
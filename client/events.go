@@ -0,0 +1,111 @@
+// events.go - notifications about update session progress
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import "github.com/Hexawolf/SSProto/ssproto"
+
+// Event is implemented by all session events. Use a type switch to tell them
+// apart.
+type Event interface {
+	event()
+}
+
+// Connected is emitted after protocol version was checked.
+type Connected struct {
+	ServerVersion uint8
+	// Optional protocol features both sides agreed on.
+	Capabilities ssproto.Capabilities
+}
+
+// Selected is emitted when server told which profile and release it serves.
+// Only servers supporting profiles or channels do so.
+type Selected struct {
+	// Profile is empty if server doesn't use profiles.
+	Profile string
+	// Release is empty if server doesn't use releases.
+	Release string
+}
+
+// Queued is emitted while server is busy and we wait for our turn. It's
+// repeated when position changes and periodically while it doesn't.
+type Queued struct {
+	// Position is 1 for the next client to be served.
+	Position int
+}
+
+// Rejected is emitted when server refused to serve us. According to the
+// protocol, update is considered successful in this case.
+type Rejected struct{}
+
+// HashingProgress is emitted after each file in installation directory was
+// hashed.
+type HashingProgress struct {
+	Path   string
+	Hashed int
+	Total  int
+}
+
+// FileRemoved is emitted after file rejected by server was deleted or moved
+// to quarantine.
+type FileRemoved struct {
+	Path string
+	// Quarantine is where the file was moved to, empty if it was deleted.
+	Quarantine string
+	// Err is not nil if file could not be removed.
+	Err error
+}
+
+// FileProgress is emitted periodically while file is being received.
+type FileProgress struct {
+	Path     string
+	Received uint64
+	Size     uint64
+}
+
+// FileReceived is emitted after file was received and staged. It's moved
+// into place when all files are received.
+type FileReceived struct {
+	Path string
+	Size uint64
+}
+
+// RolledBack is emitted after changes made by an update were undone.
+type RolledBack struct {
+	// Err is the reason: error which failed the update or
+	// ErrInterruptedCommit if the update was interrupted by a crash.
+	Err error
+}
+
+// HistoryFailed is emitted when previous versions of changed files could not
+// be saved to history. The update itself is complete.
+type HistoryFailed struct {
+	Err error
+}
+
+// Done is emitted when the session finished successfully.
+type Done struct {
+	Removed  int
+	Received int
+}
+
+func (Connected) event()       {}
+func (Queued) event()          {}
+func (Rejected) event()        {}
+func (Selected) event()        {}
+func (HashingProgress) event() {}
+func (FileRemoved) event()     {}
+func (FileProgress) event()    {}
+func (FileReceived) event()    {}
+func (RolledBack) event()      {}
+func (HistoryFailed) event()   {}
+func (Done) event()            {}
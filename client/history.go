@@ -0,0 +1,345 @@
+// history.go - previous versions of files changed by updates
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// HistoryDir is a directory in installation directory which keeps previous
+// versions of files changed by the last few updates, so they can be rolled
+// back.
+const HistoryDir = ".ss-history"
+
+// Layout of history directory.
+const (
+	// File contents named by their hex-encoded hash. The same version of a
+	// file is stored once regardless of how many snapshots refer to it.
+	objectsDir = "objects"
+	// One file per update, named by sequence number.
+	snapshotsDir = "snapshots"
+)
+
+// DefaultHistoryLength is how many updates can be rolled back by default.
+const DefaultHistoryLength = 5
+
+// ErrHistoryTooShort is returned by Rollback when asked to undo more updates
+// than history remembers.
+var ErrHistoryTooShort = errors.New("client: not enough updates in history")
+
+// ErrNotInHistory is returned by Rollback when previous version of a file is
+// missing from history.
+type ErrNotInHistory struct {
+	Path string
+}
+
+func (e ErrNotInHistory) Error() string {
+	return fmt.Sprintf("client: previous version of %s is missing from history", e.Path)
+}
+
+// WithHistory sets how many updates are remembered and can be undone with
+// Rollback. Zero disables history.
+func WithHistory(n int) Option {
+	return func(c *Client) {
+		c.history = n
+	}
+}
+
+// Snapshot describes changes made by a single update.
+type Snapshot struct {
+	Time    time.Time
+	Changes []Change
+}
+
+// Change describes a single file changed by an update.
+type Change struct {
+	Path string
+	// Existed is false if the file was added by the update.
+	Existed bool
+	// Hash of the file before the update.
+	Hash ssproto.Hash
+}
+
+func (c *Client) historyPath(elem ...string) string {
+	return filepath.Join(append([]string{c.dir, HistoryDir}, elem...)...)
+}
+
+func (c *Client) objectPath(hash ssproto.Hash) string {
+	return c.historyPath(objectsDir, hex.EncodeToString(hash[:]))
+}
+
+// snapshotNames lists snapshot files from the oldest to the newest one.
+func (c *Client) snapshotNames() ([]string, error) {
+	dirs, err := os.ReadDir(c.historyPath(snapshotsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, d := range dirs {
+		if !d.IsDir() && filepath.Ext(d.Name()) == "" {
+			res = append(res, d.Name())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// History returns remembered updates from the oldest to the newest one.
+func (c *Client) History() ([]Snapshot, error) {
+	names, err := c.snapshotNames()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Snapshot, 0, len(names))
+	for _, name := range names {
+		f, err := os.Open(c.historyPath(snapshotsDir, name))
+		if err != nil {
+			return nil, err
+		}
+		var snap Snapshot
+		err = gob.NewDecoder(f).Decode(&snap)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, snap)
+	}
+	return res, nil
+}
+
+// copyFile copies src to dst through a temporary file, so dst never contains
+// partial contents.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return err
+	}
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// storeObject saves contents of file at src to history. src is moved if
+// possible, otherwise it's left untouched.
+func (c *Client) storeObject(src string, hash ssproto.Hash, move bool) error {
+	dst := c.objectPath(hash)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if move {
+		return moveFile(src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return err
+	}
+	// Removed files go to quarantine too, so try not to store them twice.
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// saveHistory records changes done by commit and moves previous versions of
+// files from backup directory to history. hashes are known hashes of previous
+// versions.
+func (c *Client) saveHistory(journal []journalEntry, removeErrs map[string]error, hashes map[string]ssproto.Hash) error {
+	if c.history == 0 {
+		return nil
+	}
+	snap := Snapshot{Time: time.Now()}
+	for _, e := range journal {
+		if _, failed := removeErrs[e.Path]; failed {
+			continue
+		}
+		change := Change{Path: e.Path}
+		if e.Op != opAdd {
+			backup := c.stagingPath(backupDir, e.Path)
+			hash, ok := hashes[e.Path]
+			if !ok {
+				var err error
+				if hash, _, err = c.hashCache.Hash(backup); err != nil {
+					return err
+				}
+			}
+			// Removed files are still needed for quarantine.
+			if err := c.storeObject(backup, hash, e.Op == opReplace); err != nil {
+				return err
+			}
+			change.Existed = true
+			change.Hash = hash
+		}
+		snap.Changes = append(snap.Changes, change)
+	}
+
+	names, err := c.snapshotNames()
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(names) != 0 {
+		last, _ := strconv.Atoi(names[len(names)-1])
+		next = last + 1
+	}
+	location := c.historyPath(snapshotsDir, fmt.Sprintf("%08d", next))
+	if err := os.MkdirAll(filepath.Dir(location), 0775); err != nil {
+		return err
+	}
+	f, err := os.Create(location + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(snap)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(location+".tmp", location)
+	}
+	if err != nil {
+		os.Remove(location + ".tmp")
+		return err
+	}
+	return c.pruneHistory()
+}
+
+// pruneHistory deletes snapshots beyond history length and file versions no
+// snapshot refers to.
+func (c *Client) pruneHistory() error {
+	names, err := c.snapshotNames()
+	if err != nil {
+		return err
+	}
+	for len(names) > c.history {
+		if err := os.Remove(c.historyPath(snapshotsDir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+
+	history, err := c.History()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, snap := range history {
+		for _, change := range snap.Changes {
+			if change.Existed {
+				used[hex.EncodeToString(change.Hash[:])] = true
+			}
+		}
+	}
+	objects, err := os.ReadDir(c.historyPath(objectsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, obj := range objects {
+		if !used[obj.Name()] {
+			os.Remove(c.historyPath(objectsDir, obj.Name()))
+		}
+	}
+	return nil
+}
+
+// Rollback undoes changes made by the last n updates: previous versions of
+// files are taken from history and files added by those updates are removed.
+// Changes are applied as a single transaction, like an update, and are
+// recorded in history as well, so rollback can be undone too.
+func (c *Client) Rollback(n int) error {
+	if err := c.recoverCommit(); err != nil {
+		return err
+	}
+	history, err := c.History()
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > len(history) {
+		return ErrHistoryTooShort
+	}
+
+	// The oldest change of each file tells what it was before all of them.
+	target := make(map[string]Change)
+	for i := len(history) - 1; i >= len(history)-n; i-- {
+		for _, change := range history[i].Changes {
+			target[change.Path] = change
+		}
+	}
+	paths := make([]string, 0, len(target))
+	for path := range target {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	cs := changeSet{
+		hashes: make(map[string]ssproto.Hash),
+		stamp:  time.Now().Format(quarantineTimeFormat),
+	}
+	for _, path := range paths {
+		change := target[path]
+		hash, _, err := c.hashCache.Hash(filepath.Join(c.dir, path))
+		exists := err == nil
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if exists {
+			cs.hashes[path] = hash
+		}
+		if !change.Existed {
+			if exists {
+				cs.toRemove = append(cs.toRemove, path)
+			}
+			continue
+		}
+		if exists && hash == change.Hash {
+			continue
+		}
+		c.removePartial(path)
+		err = copyFile(c.objectPath(change.Hash), c.stagingPath(stagedFilesDir, path))
+		if os.IsNotExist(err) {
+			return ErrNotInHistory{Path: path}
+		}
+		if err != nil {
+			return err
+		}
+		cs.staged = append(cs.staged, stagedFile{Path: path, Hash: change.Hash})
+	}
+	_, err = c.commit(cs)
+	return err
+}
@@ -10,9 +10,10 @@
 //
 // The above copyright notice and this permission notice shall be included in all
 // copies or substantial portions of the Software.
-package main
+package client
 
 import (
+	"encoding/json"
 	"runtime"
 
 	"github.com/shirou/gopsutil/mem"
@@ -60,3 +61,7 @@ func GetMachineInfo() MachineInfo {
 	info.OS = runtime.GOOS
 	return info
 }
+
+func machineInfoJSON() ([]byte, error) {
+	return json.Marshal(GetMachineInfo())
+}
@@ -0,0 +1,130 @@
+// index.go - client files hashing ("indexing")
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// DefaultExcluded is a collection of snowflakes ❄️
+// This is a list of files and dirs that should not be hashed. That is, their existence is ignored by updater.
+var DefaultExcluded = []string{
+	"/?ignored_*",
+	"assets",
+	"screenshots",
+	"saves",
+	"library",
+}
+
+// DefaultManaged lists directories where excess files are deleted when server
+// doesn't send its own list (servers without ssproto.CapManagedDirs).
+var DefaultManaged = []ssproto.ManagedDir{
+	{Path: "mods"},
+}
+
+func (c *Client) shouldExclude(path string) bool {
+	for _, pattern := range c.excluded {
+		if match, _ := regexp.MatchString(pattern, filepath.ToSlash(path)); match {
+			return true
+		}
+	}
+	return false
+}
+
+// isCacheFile reports whether path belongs to hash cache.
+func (c *Client) isCacheFile(path string) bool {
+	if c.hashCache == nil {
+		return false
+	}
+	cachePath, err := filepath.Abs(c.hashCache.Path())
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return path == cachePath || path == cachePath+".tmp"
+}
+
+// collectRecurse lists files in installation directory. Returned paths are
+// relative to it.
+func (c *Client) collectRecurse() ([]string, error) {
+	var res []string
+	walkfn := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if rel != "." && (isUpdaterDir(rel) || c.shouldExclude(rel)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if c.isCacheFile(path) || c.shouldExclude(rel) {
+			return nil
+		}
+
+		res = append(res, rel)
+		return nil
+	}
+	err := filepath.Walk(c.dir, walkfn)
+	return res, err
+}
+
+// hashFiles hashes files in installation directory and calls each with every
+// hash as soon as it's ready, from the calling goroutine. Stops at the first
+// error.
+func (c *Client) hashFiles(each func(path string, hash ssproto.Hash) error) error {
+	list, err := c.collectRecurse()
+	if err != nil {
+		return err
+	}
+
+	fullPaths := make([]string, len(list))
+	for i, path := range list {
+		fullPaths[i] = filepath.Join(c.dir, path)
+	}
+	var firstErr error
+	hashed := 0
+	c.hashCache.HashFiles(fullPaths, func(r hashcache.Result) {
+		if firstErr != nil {
+			return
+		}
+		if r.Err != nil {
+			firstErr = r.Err
+			return
+		}
+		path := list[r.Index]
+		hashed++
+		c.emit(HashingProgress{Path: path, Hashed: hashed, Total: len(list)})
+		firstErr = each(path, r.Hash)
+	})
+	if firstErr != nil {
+		return firstErr
+	}
+	if c.hashCache != nil {
+		// Cache only saves time, so errors are ignored.
+		c.hashCache.Save()
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// io.go - receiving files from the update server
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Hexawolf/SSProto/delta"
+	"github.com/Hexawolf/SSProto/ssproto"
+	"golang.org/x/crypto/blake2b"
+)
+
+// copyWithProgress copies file contents from src to dst, reporting progress.
+// written is the amount of bytes already present in dst.
+func (c *Client) copyWithProgress(filename string, written, size uint64, src io.Reader, dst io.Writer) error {
+	buf := make([]byte, 65536) // There is nothing wrong with using big buffers.
+
+	for {
+		nr, er := src.Read(buf)
+		if nr > 0 {
+			nw, ew := dst.Write(buf[0:nr])
+			if nw > 0 {
+				written += uint64(nw)
+			}
+			if ew != nil {
+				return ew
+			}
+			if nr != nw {
+				return io.ErrShortWrite
+			}
+		}
+		if er != nil {
+			if er == io.EOF {
+				break
+			}
+			return er
+		}
+
+		c.emit(FileProgress{Path: filename, Received: written, Size: size})
+	}
+	if written != size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// ErrUnexpectedDelta is returned when server sends delta for a file we didn't
+// send signature of.
+var ErrUnexpectedDelta = errors.New("client: delta received for unknown file")
+
+// ErrHashMismatch is returned when received file contents don't match the
+// hash sent by server. Such file is not moved into place.
+type ErrHashMismatch struct {
+	Path string
+}
+
+func (e ErrHashMismatch) Error() string {
+	return fmt.Sprintf("client: hash mismatch for received file %s", e.Path)
+}
+
+// progressWriter counts bytes written to w and reports progress.
+type progressWriter struct {
+	c        *Client
+	w        io.Writer
+	filename string
+	size     uint64
+	written  uint64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += uint64(n)
+	p.c.emit(FileProgress{Path: p.filename, Received: p.written, Size: p.size})
+	return n, err
+}
+
+// openPartial opens interrupted download to continue writing it at offset.
+// If h is not nil, contents already downloaded are written to it.
+func openPartial(path string, offset uint64, h hash.Hash) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0664)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && uint64(fi.Size()) < offset {
+		err = ssproto.ErrBadOffset
+	}
+	if err == nil {
+		err = f.Truncate(int64(offset))
+	}
+	if err == nil && h != nil {
+		_, err = io.CopyN(h, f, int64(offset))
+	} else if err == nil {
+		_, err = f.Seek(int64(offset), io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// signature computes block signature of a file in installation directory.
+func (c *Client) signature(path string) (*ssproto.Signature, error) {
+	f, err := os.Open(filepath.Join(c.dir, path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return delta.Sign(f, delta.BlockSize(fi.Size()))
+}
+
+// patch rebuilds file from its old version at fullPath and delta operations
+// received from server, writing result to dst.
+func (s *Session) patch(filePath, fullPath string, size uint64, dst io.Writer) error {
+	blockSize, ok := s.blockSizes[filePath]
+	if !ok {
+		return ErrUnexpectedDelta
+	}
+	old, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	pw := &progressWriter{c: s.client, w: dst, filename: filePath, size: size}
+	err = delta.Patch(old, blockSize, s.dec.ReadDeltaOp, pw)
+	if err != nil {
+		return err
+	}
+	if pw.written != size {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func (s *Session) savePacket(p *ssproto.File) error {
+	c := s.client
+	filePath := ssproto.FromWire(p.Path)
+	fullPath, err := c.safeJoin(filePath)
+	if err != nil {
+		return err
+	}
+
+	var entry ssproto.ManifestEntry
+	if s.manifest != nil {
+		var ok bool
+		entry, ok = s.manifest.Lookup(p.Path)
+		if !ok || entry.Size != p.Size {
+			return ErrManifestMismatch{Path: filePath}
+		}
+	}
+
+	// File is moved into place by commit once everything is received.
+	stagedPath := c.stagingPath(stagedFilesDir, filePath)
+	hashPath := c.stagingPath(stagedHashesDir, filePath)
+	err = os.MkdirAll(filepath.Dir(stagedPath), 0775)
+	if err != nil {
+		return err
+	}
+
+	resumable := s.caps.Has(ssproto.CapResume)
+	// Contents are hashed while being written, so we don't need to read
+	// the file again. Commit verifies installed files against this hash.
+	h, _ := blake2b.New256(nil)
+	var f *os.File
+	if p.Flags&ssproto.FlagResumed != 0 {
+		f, err = openPartial(stagedPath, p.Offset, h)
+	} else {
+		f, err = os.Create(stagedPath)
+	}
+	if err != nil {
+		return err
+	}
+	dst := io.MultiWriter(f, h)
+	if resumable {
+		err = os.MkdirAll(filepath.Dir(hashPath), 0775)
+		if err == nil {
+			err = ioutil.WriteFile(hashPath, p.Hash[:], 0664)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	if p.Flags&ssproto.FlagDelta != 0 {
+		err = s.patch(filePath, fullPath, p.Size, dst)
+	} else {
+		err = c.copyWithProgress(filePath, p.Offset, p.Size, p.Body, dst)
+	}
+	var mismatch bool
+	var sum ssproto.Hash
+	copy(sum[:], h.Sum(nil))
+	if err == nil {
+		if s.caps.HasFileHash() && sum != p.Hash {
+			err = ErrHashMismatch{Path: filePath}
+			mismatch = true
+		} else if s.manifest != nil && sum != entry.Hash {
+			err = ErrManifestMismatch{Path: filePath}
+			mismatch = true
+		}
+	}
+	if err != nil {
+		f.Close()
+		// Keep what we got so far if server can continue the transfer
+		// next time. Delta can't be resumed, though, and there is no
+		// point in resuming corrupted file.
+		if !resumable || mismatch || p.Flags&ssproto.FlagDelta != 0 {
+			c.removePartial(filePath)
+		}
+		return err
+	}
+
+	f.Close()
+
+	if s.manifest != nil && entry.Mode != 0 {
+		os.Chmod(stagedPath, os.FileMode(entry.Mode)&os.ModePerm)
+	}
+	s.staged = append(s.staged, stagedFile{Path: filePath, Hash: sum})
+
+	c.emit(FileReceived{Path: filePath, Size: p.Size})
+	return nil
+}
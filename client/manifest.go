@@ -0,0 +1,124 @@
+// manifest.go - verification of signed release manifests
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// ErrNoManifest is returned by Connect when public key was pinned with
+// WithPublicKey, but server can't send signed manifest.
+var ErrNoManifest = errors.New("client: server doesn't provide release manifest")
+
+// ErrManifestRollback is returned when server sends a manifest older than the
+// one accepted before, which may be an attempt to install known vulnerable
+// files.
+var ErrManifestRollback = errors.New("client: release manifest is older than installed one")
+
+// ErrManifestMismatch is returned when server sends a file which is not a
+// part of the release described by manifest.
+type ErrManifestMismatch struct {
+	Path string
+}
+
+func (e ErrManifestMismatch) Error() string {
+	return fmt.Sprintf("client: received file %s doesn't match release manifest", e.Path)
+}
+
+// WithPublicKey pins the key release manifests are signed with. Server must
+// send a manifest signed with this key and every received file must be
+// listed in it, otherwise update fails before the file is moved into place.
+func WithPublicKey(key ed25519.PublicKey) Option {
+	return func(c *Client) {
+		c.publicKey = key
+	}
+}
+
+// StateDir is a directory in installation directory where updater keeps its
+// own state, like timestamp of last accepted manifest or hash cache. It is
+// never hashed and server can't send files into it.
+const StateDir = ".ss-state"
+
+// manifestTimeLocation returns path of a file with timestamp of last accepted
+// manifest.
+func (c *Client) manifestTimeLocation() string {
+	return filepath.Join(c.dir, StateDir, "manifest.time")
+}
+
+// oldManifestTimeLocation is where older versions kept the timestamp. Server
+// could make client remove it from there.
+func (c *Client) oldManifestTimeLocation() string {
+	return filepath.Join(c.dir, "config", "manifest.time")
+}
+
+// lastManifestTime returns timestamp of last accepted manifest or 0 if there
+// was none.
+func (c *Client) lastManifestTime() int64 {
+	b, err := ioutil.ReadFile(c.manifestTimeLocation())
+	if os.IsNotExist(err) {
+		b, err = ioutil.ReadFile(c.oldManifestTimeLocation())
+	}
+	if err != nil || len(b) != 8 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (c *Client) saveManifestTime(t int64) error {
+	location := c.manifestTimeLocation()
+	if err := os.MkdirAll(filepath.Dir(location), 0775); err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(t))
+	if err := ioutil.WriteFile(location, b, 0664); err != nil {
+		return err
+	}
+	os.Remove(c.oldManifestTimeLocation())
+	return nil
+}
+
+// readManifest receives release manifest and checks it against pinned key.
+func (s *Session) readManifest() error {
+	signed, err := s.dec.ReadManifest()
+	if err != nil {
+		return err
+	}
+	m, err := signed.Verify(s.client.publicKey)
+	if err != nil {
+		return err
+	}
+	if m.Timestamp < s.client.lastManifestTime() {
+		return ErrManifestRollback
+	}
+	s.manifest = m
+	return nil
+}
+
+// inManifest reports whether file with given path and hash is a part of the
+// signed release. It's always false if manifest is not used.
+func (s *Session) inManifest(path string, hash ssproto.Hash) bool {
+	if s.manifest == nil {
+		return false
+	}
+	entry, ok := s.manifest.Lookup(ssproto.ToWire(path))
+	return ok && entry.Hash == hash
+}
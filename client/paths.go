@@ -0,0 +1,94 @@
+// paths.go - keeping received files inside of installation directory
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// within reports whether path is root or is located inside of it. Both paths
+// must be absolute and clean.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isUpdaterDir reports whether path relative to installation directory is one
+// of directories updater keeps its own files in. Such directories are never
+// hashed and server can't send files into them.
+func isUpdaterDir(path string) bool {
+	return strings.EqualFold(path, StagingDir) || strings.EqualFold(path, QuarantineDir) ||
+		strings.EqualFold(path, HistoryDir) || strings.EqualFold(path, StateDir)
+}
+
+// safeJoin returns full path of a received file. path must already be checked
+// with ssproto.CheckPath, so only updater's own directories and symlinks are
+// left to take care of: if any existing directory on the way to the file is a
+// symlink pointing outside of installation directory, ssproto.ErrUnsafePath is
+// returned.
+func (c *Client) safeJoin(path string) (string, error) {
+	first := strings.SplitN(ssproto.ToWire(path), "/", 2)[0]
+	if isUpdaterDir(first) {
+		return "", ssproto.ErrUnsafePath{
+			Path:   ssproto.ToWire(path),
+			Reason: "directory is reserved for updater",
+		}
+	}
+
+	fullPath := filepath.Join(c.dir, path)
+
+	root, err := filepath.EvalSymlinks(c.dir)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	// Directories that don't exist yet will be created by us, so only the
+	// deepest existing one matters.
+	existing := filepath.Dir(fullPath)
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	real, err = filepath.Abs(real)
+	if err != nil {
+		return "", err
+	}
+	if !within(root, real) {
+		return "", ssproto.ErrUnsafePath{
+			Path:   ssproto.ToWire(path),
+			Reason: "symlink points outside of installation directory",
+		}
+	}
+	return fullPath, nil
+}
@@ -0,0 +1,162 @@
+// quarantine.go - keeping removed files around for a while
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// QuarantineDir is a directory in installation directory where files removed
+// on server's request are moved to. Each session which removed something
+// gets its own subdirectory named after the time it started.
+const QuarantineDir = ".ss-quarantine"
+
+// quarantineTimeFormat names quarantine subdirectories. It sorts in
+// chronological order and is a valid file name on every OS.
+const quarantineTimeFormat = "2006-01-02_15-04-05"
+
+// DefaultQuarantineRetention is how long removed files are kept by default.
+const DefaultQuarantineRetention = 30 * 24 * time.Hour
+
+// ErrNoQuarantine is returned by Restore when there is nothing to restore.
+var ErrNoQuarantine = errors.New("client: no quarantined files")
+
+// WithQuarantineRetention sets how long removed files are kept in quarantine.
+// Zero makes client delete files right away.
+func WithQuarantineRetention(d time.Duration) Option {
+	return func(c *Client) {
+		c.retention = d
+	}
+}
+
+// quarantine deletes removed file src or moves it to quarantine subdirectory
+// stamp, path is relative to installation directory. Returns new location of
+// the file or an empty string if it was deleted.
+func (c *Client) quarantine(src, path, stamp string) (string, error) {
+	if c.retention == 0 {
+		return "", os.Remove(src)
+	}
+	dst := filepath.Join(c.dir, QuarantineDir, stamp, path)
+	if err := moveFile(src, dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// Quarantined lists names of quarantine subdirectories from the oldest to the
+// newest one.
+func (c *Client) Quarantined() ([]string, error) {
+	dirs, err := os.ReadDir(filepath.Join(c.dir, QuarantineDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, d := range dirs {
+		if _, err := time.Parse(quarantineTimeFormat, d.Name()); d.IsDir() && err == nil {
+			res = append(res, d.Name())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// pruneQuarantine deletes quarantine subdirectories older than retention.
+func (c *Client) pruneQuarantine() error {
+	names, err := c.Quarantined()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		t, _ := time.ParseInLocation(quarantineTimeFormat, name, time.Local)
+		if time.Since(t) <= c.retention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, QuarantineDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore moves files from quarantine subdirectory back into place. If name is
+// empty, the newest one is restored. Files which exist in installation
+// directory again are left in quarantine. Returns paths of restored files.
+func (c *Client) Restore(name string) ([]string, error) {
+	if name == "" {
+		names, err := c.Quarantined()
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			return nil, ErrNoQuarantine
+		}
+		name = names[len(names)-1]
+	}
+	if _, err := time.Parse(quarantineTimeFormat, name); err != nil {
+		return nil, &os.PathError{Op: "restore", Path: name, Err: os.ErrNotExist}
+	}
+	root := filepath.Join(c.dir, QuarantineDir, name)
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	var restored []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(c.dir, rel)
+		if _, err := os.Lstat(dst); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+			return err
+		}
+		if err := os.Rename(path, dst); err != nil {
+			return err
+		}
+		restored = append(restored, rel)
+		return nil
+	})
+	if err != nil {
+		return restored, err
+	}
+	removeEmptyDirs(root)
+	return restored, nil
+}
+
+// removeEmptyDirs deletes directory tree at root if there are no files left.
+func removeEmptyDirs(root string) {
+	var dirs []string
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	// Deepest directories go first, non-empty ones just fail to be removed.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
@@ -0,0 +1,80 @@
+// resume.go - keeping track of interrupted downloads
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// collectPartials finds interrupted downloads in staging directory. Expected
+// hash of each one is stored in stagedHashesDir under the same path. Files
+// which were received completely but not committed are found too, server
+// then sends just their headers.
+func (c *Client) collectPartials() ([]ssproto.ResumeRequest, error) {
+	root := c.stagingPath(stagedHashesDir)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil, nil
+	}
+	var res []ssproto.ResumeRequest
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		partial, err := os.Stat(c.stagingPath(stagedFilesDir, rel))
+		if err != nil {
+			// Nothing to resume, sidecar is stale.
+			os.Remove(path)
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil || len(b) != ssproto.HashSize {
+			return nil
+		}
+		req := ssproto.ResumeRequest{Path: rel, Offset: uint64(partial.Size())}
+		copy(req.Hash[:], b)
+		res = append(res, req)
+		return nil
+	})
+	return res, err
+}
+
+// removePartial deletes interrupted download of a file.
+func (c *Client) removePartial(path string) {
+	os.Remove(c.stagingPath(stagedFilesDir, path))
+	os.Remove(c.stagingPath(stagedHashesDir, path))
+}
+
+// sendResumeRequests asks server to continue interrupted downloads.
+func (s *Session) sendResumeRequests() error {
+	partials, err := s.client.collectPartials()
+	if err != nil {
+		return err
+	}
+	for _, req := range partials {
+		if err := s.enc.WriteResumeRequest(req); err != nil {
+			return err
+		}
+	}
+	return s.enc.WriteResumeRequestsEnd()
+}
@@ -0,0 +1,100 @@
+// selection.go - requesting a profile and release channel
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"errors"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// ErrNoChannels is returned by Connect when a channel was requested with
+// WithChannel, but server doesn't support channels.
+var ErrNoChannels = errors.New("client: server doesn't support channels")
+
+// ErrUnknownChannel is returned by Update when server refused to serve
+// requested channel.
+var ErrUnknownChannel = errors.New("client: server doesn't serve requested channel")
+
+// WithChannel sets release channel (like "stable" or "beta") to be updated
+// from. By default server decides.
+func WithChannel(name string) Option {
+	return func(c *Client) {
+		c.channel = name
+	}
+}
+
+// ErrNoProfiles is returned by Connect when a profile was requested with
+// WithProfile, but server doesn't support profiles.
+var ErrNoProfiles = errors.New("client: server doesn't support profiles")
+
+// ErrUnknownProfile is returned by Update when server refused to serve
+// requested profile.
+var ErrUnknownProfile = errors.New("client: server doesn't serve requested profile")
+
+// ErrBadSelection is returned when server replied to profile and channel
+// requests with unknown status.
+var ErrBadSelection = errors.New("client: unknown reply to profile and channel requests")
+
+// WithProfile sets profile (one of sets of files served by the same server)
+// to be updated from. By default server decides.
+func WithProfile(name string) Option {
+	return func(c *Client) {
+		c.profile = name
+	}
+}
+
+// sendRequests requests configured profile and channel. Server replies to
+// them after identification, see readSelection.
+func (s *Session) sendRequests() error {
+	c := s.client
+	if c.channel != "" && !s.caps.Has(ssproto.CapChannels) {
+		return ErrNoChannels
+	}
+	if c.profile != "" && !s.caps.Has(ssproto.CapProfiles) {
+		return ErrNoProfiles
+	}
+	if s.caps.Has(ssproto.CapChannels) {
+		if err := s.enc.WriteChannelRequest(c.channel); err != nil {
+			return err
+		}
+	}
+	if s.caps.Has(ssproto.CapProfiles) {
+		return s.enc.WriteProfileRequest(c.profile)
+	}
+	return nil
+}
+
+// readSelection receives profile and release server is going to serve.
+func (s *Session) readSelection() error {
+	if s.caps&(ssproto.CapChannels|ssproto.CapProfiles) == 0 {
+		return nil
+	}
+	sel, err := s.dec.ReadSelection()
+	if err != nil {
+		return err
+	}
+	switch sel.Status {
+	case ssproto.SelectionOK:
+	case ssproto.SelectionUnknownProfile:
+		return ErrUnknownProfile
+	case ssproto.SelectionUnknownChannel:
+		return ErrUnknownChannel
+	case ssproto.SelectionNoManifest:
+		return ErrNoManifest
+	default:
+		return ErrBadSelection
+	}
+	s.client.emit(Selected{Profile: sel.Profile, Release: sel.Release})
+	return nil
+}
@@ -0,0 +1,346 @@
+// session.go - a single update session with the server
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// Session is an established connection to the update server. Session can
+// be used for a single Update only.
+type Session struct {
+	client *Client
+	conn   net.Conn
+	enc    *ssproto.Encoder
+	dec    *ssproto.Decoder
+
+	// Negotiated protocol version and capabilities.
+	version uint8
+	caps    ssproto.Capabilities
+
+	// Verified release manifest, nil if public key was not pinned.
+	manifest *ssproto.Manifest
+
+	// Directories where files unknown to server are deleted.
+	managed []ssproto.ManagedDir
+
+	// Files server has another version of, see ssproto.VerdictChanged.
+	changed []string
+	// Block sizes of signatures sent to server, by path.
+	blockSizes map[string]uint32
+	// Files received during this session, waiting in staging directory.
+	staged []stagedFile
+	// Files server asked to remove, they are removed on commit.
+	toRemove []string
+	// Hashes of local files sent to server.
+	hashes map[string]ssproto.Hash
+
+	// Time session started at, names quarantine directory.
+	started time.Time
+
+	removed  int
+	received int
+}
+
+// Close closes connection to the server.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+// Update identifies the client, sends a list of local files and applies
+// changes requested by server: removes excess files and downloads new ones.
+// Changes are applied only after everything is downloaded, and are undone if
+// any of them fails.
+// Rejection of update request by server is not an error, Rejected event is
+// emitted instead.
+func (s *Session) Update() error {
+	c := s.client
+
+	// Undo half-applied update left by a crash before looking at files.
+	if err := c.recoverCommit(); err != nil {
+		return err
+	}
+
+	if s.caps.Has(ssproto.CapQueue) {
+		if err := s.waitQueue(); err != nil {
+			return err
+		}
+	}
+
+	// Generate new UUID/load saved UUID.
+	uuid, err := LoadUUID(c.dir)
+	if err != nil {
+		return err
+	}
+	err = s.enc.WriteUUID(uuid)
+	if err != nil {
+		return err
+	}
+
+	connectionAccepted, err := s.dec.ReadBool()
+	if err != nil {
+		return err
+	}
+	if !connectionAccepted {
+		c.emit(Rejected{})
+		return nil
+	}
+	if err := s.readSelection(); err != nil {
+		return err
+	}
+
+	hwinfo, err := c.hwinfo()
+	if err != nil {
+		return err
+	}
+	err = s.enc.WriteBlob(hwinfo)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is touched before we know what the release consists of.
+	if s.caps.Has(ssproto.CapManifest) {
+		if err := s.readManifest(); err != nil {
+			return err
+		}
+	}
+
+	s.managed = DefaultManaged
+	if s.caps.Has(ssproto.CapManagedDirs) {
+		if err := s.readManagedDirs(); err != nil {
+			return err
+		}
+	}
+
+	// Collect hashes of files and send them.
+	if err := s.exchangeHashList(); err != nil {
+		return err
+	}
+
+	if s.caps.Has(ssproto.CapDelta) {
+		if err := s.sendSignatures(); err != nil {
+			return err
+		}
+	}
+
+	if s.caps.Has(ssproto.CapResume) {
+		if err := s.sendResumeRequests(); err != nil {
+			return err
+		}
+	}
+
+	// Apply "changes" request by server - download new files.
+	for {
+		p, end, err := s.dec.ReadFile()
+		// Legacy servers just close the connection after the last file.
+		// Newer ones mark the end, so an update cut short is not applied.
+		if err == io.EOF && s.version == ssproto.VersionLegacy {
+			break
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if end {
+			break
+		}
+
+		if err := s.savePacket(p); err != nil {
+			return err
+		}
+		s.received++
+	}
+
+	// Everything is downloaded, now install it in one go.
+	s.removed, err = c.commit(changeSet{
+		staged:   s.staged,
+		toRemove: s.toRemove,
+		hashes:   s.hashes,
+		stamp:    s.started.Format(quarantineTimeFormat),
+	})
+	if err != nil {
+		return err
+	}
+	// Downloads server didn't continue are not needed anymore.
+	os.RemoveAll(c.stagingPath())
+
+	// Stale quarantine is removed next time if this fails.
+	c.pruneQuarantine()
+
+	if s.manifest != nil {
+		if err := c.saveManifestTime(s.manifest.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	c.emit(Done{Removed: s.removed, Received: s.received})
+	return nil
+}
+
+// ErrBadVerdicts is returned when server replied to a different number of
+// hash-list entries than it was sent.
+var ErrBadVerdicts = errors.New("client: number of verdicts doesn't match hash-list")
+
+// exchangeHashList sends hashes of local files to the server and applies its
+// verdicts.
+func (s *Session) exchangeHashList() error {
+	var sent []ssproto.HashListEntry
+
+	if s.caps.Has(ssproto.CapBatchVerdicts) {
+		// Server doesn't reply until the whole list is received, so each
+		// entry is sent right after hashing.
+		err := s.client.hashFiles(func(path string, hash ssproto.Hash) error {
+			entry := ssproto.HashListEntry{Hash: hash, Path: path}
+			sent = append(sent, entry)
+			return s.enc.WriteHashListEntry(entry)
+		})
+		if err != nil {
+			return err
+		}
+		if err := s.enc.WriteTerminator(); err != nil {
+			return err
+		}
+		verdicts, err := s.dec.ReadVerdicts()
+		if err != nil {
+			return err
+		}
+		if len(verdicts) != len(sent) {
+			return ErrBadVerdicts
+		}
+		for i, entry := range sent {
+			s.applyVerdict(entry, verdicts[i])
+		}
+		return nil
+	}
+
+	err := s.client.hashFiles(func(path string, hash ssproto.Hash) error {
+		sent = append(sent, ssproto.HashListEntry{Hash: hash, Path: path})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Server replies to each entry, so replies are read while entries are
+	// still being sent. Otherwise both sides may end up blocked on full
+	// socket buffers.
+	errc := make(chan error, 1)
+	go func() {
+		for _, entry := range sent {
+			if err := s.enc.WriteHashListEntry(entry); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- s.enc.WriteTerminator()
+	}()
+	for _, entry := range sent {
+		verdict, err := s.dec.ReadVerdict()
+		if err != nil {
+			// Writer is unblocked when connection is closed.
+			return err
+		}
+		s.applyVerdict(entry, verdict)
+	}
+	return <-errc
+}
+
+// readManagedDirs receives directories where server wants excess files to be
+// deleted.
+func (s *Session) readManagedDirs() error {
+	s.managed = nil
+	for {
+		m, end, err := s.dec.ReadManagedDir()
+		if err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+		s.managed = append(s.managed, m)
+	}
+}
+
+// isManaged reports whether path is inside of any managed directory.
+func (s *Session) isManaged(path string) bool {
+	for _, m := range s.managed {
+		if m.Manages(ssproto.ToWire(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyVerdict remembers that file should be removed or that server is going
+// to send another version of it.
+func (s *Session) applyVerdict(entry ssproto.HashListEntry, verdict ssproto.Verdict) {
+	path := entry.Path
+	s.hashes[path] = entry.Hash
+	if verdict == ssproto.VerdictChanged {
+		s.changed = append(s.changed, path)
+		return
+	}
+	// Files of signed release are never removed on server's request.
+	if s.inManifest(path, entry.Hash) {
+		return
+	}
+	if verdict == ssproto.VerdictRemove && s.isManaged(path) {
+		s.toRemove = append(s.toRemove, path)
+	}
+}
+
+// sendSignatures sends block signatures of files server has another version
+// of, so it can send only changed blocks.
+func (s *Session) sendSignatures() error {
+	for _, path := range s.changed {
+		sig, err := s.client.signature(path)
+		if err != nil {
+			// Server will send the whole file then.
+			continue
+		}
+		sig.Path = path
+		if err := s.enc.WriteSignature(*sig); err != nil {
+			return err
+		}
+		s.blockSizes[path] = sig.BlockSize
+	}
+	return s.enc.WriteSignaturesEnd()
+}
+
+// ErrServerBusy is returned when server closed connection instead of putting
+// us to the wait queue, because the queue is full.
+var ErrServerBusy = errors.New("client: server is busy, try again later")
+
+// waitQueue reads queue positions until server is ready to serve us.
+func (s *Session) waitQueue() error {
+	for {
+		pos, err := s.dec.ReadQueuePosition()
+		if err == io.EOF {
+			return ErrServerBusy
+		}
+		if err != nil {
+			return err
+		}
+		if pos == 0 {
+			return nil
+		}
+		s.client.emit(Queued{Position: int(pos)})
+	}
+}
@@ -0,0 +1,310 @@
+// staging.go - applying received files as a single transaction
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// StagingDir is a directory in installation directory where received files
+// are kept until the whole update is downloaded. Then they are moved into
+// place in one go, so an interrupted update never leaves a mix of old and new
+// files behind.
+const StagingDir = ".ss-staging"
+
+// Layout of staging directory.
+const (
+	// Received files, laid out like installation directory.
+	stagedFilesDir = "files"
+	// Expected hashes of received files, see collectPartials.
+	stagedHashesDir = "hashes"
+	// Previous versions of replaced and removed files while commit is in
+	// progress.
+	backupDir = "backup"
+	// List of operations done by commit. It exists only while commit is in
+	// progress, so if it's found on startup, the commit was interrupted.
+	journalFile = "journal"
+)
+
+// Journal operations.
+const (
+	// New file is moved into place.
+	opAdd = 'A'
+	// Existing file is moved to backup and replaced with received one.
+	opReplace = 'R'
+	// Existing file is moved to backup.
+	opRemove = 'D'
+)
+
+// ErrInterruptedCommit is reported in RolledBack event when changes of a
+// previous update which didn't finish were undone.
+var ErrInterruptedCommit = errors.New("client: previous update was interrupted")
+
+// ErrBadJournal is returned when commit journal can't be parsed.
+var ErrBadJournal = errors.New("client: malformed commit journal")
+
+type journalEntry struct {
+	Op   byte
+	Path string
+}
+
+// stagedFile is a file received during session and waiting for commit.
+type stagedFile struct {
+	Path string
+	Hash ssproto.Hash
+}
+
+// stagingPath returns path of an element of staging directory.
+func (c *Client) stagingPath(elem ...string) string {
+	return filepath.Join(append([]string{c.dir, StagingDir}, elem...)...)
+}
+
+// moveFile renames src to dst creating missing directories.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0775); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+// writeJournal atomically saves list of operations commit is going to do.
+func (c *Client) writeJournal(journal []journalEntry) error {
+	location := c.stagingPath(journalFile)
+	if err := os.MkdirAll(filepath.Dir(location), 0775); err != nil {
+		return err
+	}
+	f, err := os.Create(location + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range journal {
+		fmt.Fprintf(w, "%c %s\n", e.Op, ssproto.ToWire(e.Path))
+	}
+	err = w.Flush()
+	if err == nil {
+		// Journal must hit the disk before any file is touched.
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(location + ".tmp")
+		return err
+	}
+	return os.Rename(location+".tmp", location)
+}
+
+// readJournal loads journal of interrupted commit.
+func (c *Client) readJournal() ([]journalEntry, error) {
+	f, err := os.Open(c.stagingPath(journalFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var journal []journalEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 3 || line[1] != ' ' {
+			return nil, ErrBadJournal
+		}
+		switch line[0] {
+		case opAdd, opReplace, opRemove:
+		default:
+			return nil, ErrBadJournal
+		}
+		if ssproto.CheckPath(line[2:]) != nil {
+			return nil, ErrBadJournal
+		}
+		journal = append(journal, journalEntry{Op: line[0], Path: ssproto.FromWire(line[2:])})
+	}
+	return journal, scanner.Err()
+}
+
+// rollback undoes operations from journal which were done and removes the
+// journal. It's safe to call it again if it fails halfway.
+func (c *Client) rollback(journal []journalEntry) error {
+	for i := len(journal) - 1; i >= 0; i-- {
+		e := journal[i]
+		target := filepath.Join(c.dir, e.Path)
+		backup := c.stagingPath(backupDir, e.Path)
+		switch e.Op {
+		case opAdd:
+			// Staged file is gone only if it was moved into place.
+			if _, err := os.Lstat(c.stagingPath(stagedFilesDir, e.Path)); !os.IsNotExist(err) {
+				continue
+			}
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		case opReplace, opRemove:
+			if _, err := os.Lstat(backup); err != nil {
+				continue
+			}
+			if err := os.Rename(backup, target); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(c.stagingPath(journalFile))
+}
+
+// recoverCommit undoes commit which was interrupted by a crash or power loss.
+func (c *Client) recoverCommit() error {
+	journal, err := c.readJournal()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.rollback(journal); err != nil {
+		return err
+	}
+	c.emit(RolledBack{Err: ErrInterruptedCommit})
+	return nil
+}
+
+// changeSet is a set of changes applied to installation directory at once.
+type changeSet struct {
+	// Files waiting in staging directory.
+	staged []stagedFile
+	// Files to remove.
+	toRemove []string
+	// Known hashes of current versions of files, used to store them in
+	// history. Missing ones are computed.
+	hashes map[string]ssproto.Hash
+	// Name of quarantine subdirectory for removed files.
+	stamp string
+}
+
+// commit moves staged files into place and removes files listed in the change
+// set. If any file can't be replaced or doesn't match its hash afterwards,
+// all changes are undone. Files which can't be removed are only reported.
+// Previous versions of changed files are saved to history. Returns number of
+// removed files.
+func (c *Client) commit(cs changeSet) (int, error) {
+	staged := make(map[string]bool, len(cs.staged))
+	for _, f := range cs.staged {
+		staged[f.Path] = true
+	}
+	var journal []journalEntry
+	for _, path := range cs.toRemove {
+		// Servers without delta support tell us to remove changed files
+		// and send them again, received version replaces the file then.
+		if staged[path] {
+			continue
+		}
+		journal = append(journal, journalEntry{Op: opRemove, Path: path})
+	}
+	for _, f := range cs.staged {
+		op := byte(opAdd)
+		if _, err := os.Lstat(filepath.Join(c.dir, f.Path)); err == nil {
+			op = opReplace
+		}
+		journal = append(journal, journalEntry{Op: op, Path: f.Path})
+	}
+	if len(journal) == 0 {
+		return 0, nil
+	}
+	if err := c.writeJournal(journal); err != nil {
+		return 0, err
+	}
+
+	removeErrs, err := c.apply(journal)
+	if err == nil {
+		err = c.verify(cs.staged)
+	}
+	if err != nil {
+		if rerr := c.rollback(journal); rerr != nil {
+			return 0, rerr
+		}
+		c.emit(RolledBack{Err: err})
+		return 0, err
+	}
+	// Update is complete once the journal is gone.
+	if err := os.Remove(c.stagingPath(journalFile)); err != nil {
+		return 0, err
+	}
+
+	if err := c.saveHistory(journal, removeErrs, cs.hashes); err != nil {
+		c.emit(HistoryFailed{Err: err})
+	}
+
+	removed := 0
+	for _, e := range journal {
+		if e.Op != opRemove {
+			continue
+		}
+		err, failed := removeErrs[e.Path]
+		var dst string
+		if !failed {
+			dst, err = c.quarantine(c.stagingPath(backupDir, e.Path), e.Path, cs.stamp)
+		}
+		if err == nil {
+			removed++
+		}
+		c.emit(FileRemoved{Path: e.Path, Quarantine: dst, Err: err})
+	}
+	return removed, os.RemoveAll(c.stagingPath(backupDir))
+}
+
+// apply does operations from journal. Returned map contains errors of
+// removals which failed, they don't stop the commit.
+func (c *Client) apply(journal []journalEntry) (map[string]error, error) {
+	removeErrs := make(map[string]error)
+	for _, e := range journal {
+		target := filepath.Join(c.dir, e.Path)
+		backup := c.stagingPath(backupDir, e.Path)
+		switch e.Op {
+		case opRemove:
+			if err := moveFile(target, backup); err != nil {
+				removeErrs[e.Path] = err
+			}
+		case opReplace:
+			if err := moveFile(target, backup); err != nil {
+				return nil, err
+			}
+			fallthrough
+		case opAdd:
+			if err := moveFile(c.stagingPath(stagedFilesDir, e.Path), target); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return removeErrs, nil
+}
+
+// verify checks that committed files are exactly the staged ones.
+func (c *Client) verify(staged []stagedFile) error {
+	for _, f := range staged {
+		hash, _, err := hashcache.File(filepath.Join(c.dir, f.Path))
+		if err != nil {
+			return err
+		}
+		if hash != f.Hash {
+			return ErrHashMismatch{Path: f.Path}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// staging_test.go - transaction tests
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Hexawolf/SSProto/hashcache"
+)
+
+// Changed files are both removed and received when delta isn't negotiated,
+// commit must replace them instead of failing on a missing file.
+func TestCommitRemovedAndStaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ss-staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := New(WithAddress("localhost:0"), WithDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join("mods", "a.jar")
+	target := filepath.Join(dir, path)
+	staged := c.stagingPath(stagedFilesDir, path)
+	for file, data := range map[string]string{target: "old", staged: "new"} {
+		if err := os.MkdirAll(filepath.Dir(file), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash, _, err := hashcache.File(staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := c.commit(changeSet{
+		staged:   []stagedFile{{Path: path, Hash: hash}},
+		toRemove: []string{path},
+		stamp:    "test",
+	})
+	if err != nil {
+		t.Fatal("commit:", err)
+	}
+	if removed != 0 {
+		t.Errorf("%d files removed, want 0", removed)
+	}
+	got, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("file contains %q, want %q", got, "new")
+	}
+}
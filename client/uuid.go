@@ -0,0 +1,49 @@
+// uuid.go - client identification
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package client
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+func newUUID() (ssproto.UUID, error) {
+	var v ssproto.UUID
+	_, err := rand.Read(v[:])
+	return v, err
+}
+
+// LoadUUID tries to load from config/uuid.bin in dir or generate a new random
+// sequence of 32 bytes. This sequence is used for client identification.
+func LoadUUID(dir string) (ssproto.UUID, error) {
+	uuidLocation := filepath.Join(dir, "config", "uuid.bin")
+	if _, err := os.Stat(uuidLocation); err == nil {
+		var id ssproto.UUID
+		b, err := ioutil.ReadFile(uuidLocation)
+		if err != nil {
+			return id, err
+		}
+		copy(id[:], b)
+		return id, nil
+	}
+	b, err := newUUID()
+	if err != nil {
+		return b, err
+	}
+	ioutil.WriteFile(uuidLocation, b[:], 0600)
+	return b, nil
+}
@@ -0,0 +1,274 @@
+// delta.go - rsync-style block matching
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// Package delta implements block-level delta encoding similar to rsync.
+// Client computes a Signature of its old file version, server finds blocks
+// of the new version present in the signature with Diff and client rebuilds
+// the new version from copied blocks and literal data with Patch.
+package delta
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Limits of block size selected by BlockSize.
+const (
+	MinBlockSize = 2048
+	MaxBlockSize = 128 * 1024
+)
+
+// BlockSize picks block size for a file of given size. It's roughly a square
+// root of file size, so both number of blocks and block length grow slowly.
+func BlockSize(size int64) uint32 {
+	bs := int64(math.Sqrt(float64(size)))
+	// Round up to whole kibibytes.
+	bs = (bs + 1023) / 1024 * 1024
+	if bs < MinBlockSize {
+		return MinBlockSize
+	}
+	if bs > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return uint32(bs)
+}
+
+// ErrBadBlockSize is returned by Diff for signatures with block size outside
+// of [MinBlockSize, MaxBlockSize].
+var ErrBadBlockSize = errors.New("delta: signature block size out of range")
+
+// CheckBlockSize reports whether signature with given block size can be used
+// with Diff. Block sizes come from peer, so they must be checked before
+// allocating anything of that size.
+func CheckBlockSize(bs uint32) error {
+	if bs < MinBlockSize || bs > MaxBlockSize {
+		return ErrBadBlockSize
+	}
+	return nil
+}
+
+// rolling is a weak checksum which can be updated in constant time when the
+// window slides by one byte. This is the same checksum rsync uses.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rolling) init(block []byte) {
+	r.a, r.b = 0, 0
+	r.n = uint32(len(block))
+	for i, c := range block {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+}
+
+// roll removes out from the beginning of the window and appends in.
+func (r *rolling) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+// rollOut removes out from the beginning of the window, shrinking it.
+func (r *rolling) rollOut(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func strong(block []byte) (res [ssproto.StrongSize]byte) {
+	sum := blake2b.Sum256(block)
+	copy(res[:], sum[:])
+	return
+}
+
+// Sign computes signature of contents read from r split into blocks of
+// blockSize bytes. Path of returned signature is left empty.
+func Sign(r io.Reader, blockSize uint32) (*ssproto.Signature, error) {
+	sig := &ssproto.Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var weak rolling
+			weak.init(buf[:n])
+			sig.Blocks = append(sig.Blocks, ssproto.BlockSignature{
+				Weak:   weak.sum(),
+				Strong: strong(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Sink receives delta operations produced by Diff.
+type Sink interface {
+	// Copy is called when block with given index of the old version can be
+	// reused.
+	Copy(index uint64) error
+	// Data is called with literal data absent in the old version. Slice is
+	// only valid until the call returns.
+	Data(b []byte) error
+}
+
+// Diff reads new version of a file from r and describes it in terms of blocks
+// from sig. Memory usage is bounded by a few block sizes regardless of file
+// size.
+func Diff(r io.Reader, sig *ssproto.Signature, out Sink) error {
+	if err := CheckBlockSize(sig.BlockSize); err != nil {
+		return err
+	}
+	bs := int(sig.BlockSize)
+	table := make(map[uint32][]int)
+	for i, b := range sig.Blocks {
+		table[b.Weak] = append(table[b.Weak], i)
+	}
+
+	br := bufio.NewReaderSize(r, bs)
+	// buf holds pending literal data followed by current window:
+	// buf[:lit] is literal, buf[lit:] is window.
+	buf := make([]byte, 0, 2*bs+1)
+	lit := 0
+	eof := false
+
+	fill := func() error {
+		for !eof && len(buf)-lit < bs {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				eof = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			buf = append(buf, c)
+		}
+		return nil
+	}
+
+	if err := fill(); err != nil {
+		return err
+	}
+	var weak rolling
+	weak.init(buf)
+
+	for len(buf) > lit {
+		window := buf[lit:]
+		if idx, ok := match(table, sig, weak.sum(), window); ok {
+			if lit > 0 {
+				if err := out.Data(buf[:lit]); err != nil {
+					return err
+				}
+			}
+			if err := out.Copy(uint64(idx)); err != nil {
+				return err
+			}
+			buf = buf[:0]
+			lit = 0
+			if err := fill(); err != nil {
+				return err
+			}
+			weak.init(buf)
+			continue
+		}
+
+		// Slide window by one byte, moving its first byte to literal.
+		first := buf[lit]
+		lit++
+		if !eof {
+			c, err := br.ReadByte()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if err == io.EOF {
+				eof = true
+				weak.rollOut(first)
+			} else {
+				buf = append(buf, c)
+				weak.roll(first, c)
+			}
+		} else {
+			weak.rollOut(first)
+		}
+
+		if lit >= bs {
+			if err := out.Data(buf[:lit]); err != nil {
+				return err
+			}
+			buf = append(buf[:0], buf[lit:]...)
+			lit = 0
+		}
+	}
+	if lit > 0 {
+		return out.Data(buf[:lit])
+	}
+	return nil
+}
+
+func match(table map[uint32][]int, sig *ssproto.Signature, weak uint32, window []byte) (int, bool) {
+	candidates, ok := table[weak]
+	if !ok {
+		return 0, false
+	}
+	s := strong(window)
+	for _, idx := range candidates {
+		if sig.Blocks[idx].Strong == s {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// Patch writes new version of a file to dst, taking copied blocks from old.
+// Operations are read with next until DeltaEnd is received.
+func Patch(old io.ReaderAt, blockSize uint32, next func() (ssproto.DeltaOp, error), dst io.Writer) error {
+	buf := make([]byte, blockSize)
+	for {
+		op, err := next()
+		if err != nil {
+			return err
+		}
+		switch op.Code {
+		case ssproto.DeltaEnd:
+			return nil
+		case ssproto.DeltaCopy:
+			n, err := old.ReadAt(buf, int64(op.Index)*int64(blockSize))
+			if err != nil && !(err == io.EOF && n > 0) {
+				return err
+			}
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		case ssproto.DeltaData:
+			if _, err := dst.Write(op.Data); err != nil {
+				return err
+			}
+		default:
+			return ssproto.ErrBadDeltaOp
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// delta_test.go - delta encoding tests
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+package delta
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// opSink collects delta operations for Patch.
+type opSink struct {
+	ops []ssproto.DeltaOp
+}
+
+func (s *opSink) Copy(index uint64) error {
+	s.ops = append(s.ops, ssproto.DeltaOp{Code: ssproto.DeltaCopy, Index: index})
+	return nil
+}
+
+func (s *opSink) Data(b []byte) error {
+	data := append([]byte(nil), b...)
+	s.ops = append(s.ops, ssproto.DeltaOp{Code: ssproto.DeltaData, Data: data})
+	return nil
+}
+
+func (s *opSink) next() func() (ssproto.DeltaOp, error) {
+	ops := append(s.ops, ssproto.DeltaOp{Code: ssproto.DeltaEnd})
+	return func() (ssproto.DeltaOp, error) {
+		if len(ops) == 0 {
+			return ssproto.DeltaOp{}, io.ErrUnexpectedEOF
+		}
+		op := ops[0]
+		ops = ops[1:]
+		return op, nil
+	}
+}
+
+func random(rnd *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func TestRoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	old := random(rnd, 100000)
+	cases := map[string][]byte{
+		"same":      old,
+		"empty":     nil,
+		"unrelated": random(rnd, 50000),
+		"inserted":  append(append(append([]byte(nil), old[:30000]...), random(rnd, 777)...), old[30000:]...),
+		"removed":   append(append([]byte(nil), old[:10000]...), old[70001:]...),
+		"truncated": old[:54321],
+		"appended":  append(append([]byte(nil), old...), random(rnd, 5000)...),
+	}
+	for name, cur := range cases {
+		sig, err := Sign(bytes.NewReader(old), BlockSize(int64(len(old))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sink opSink
+		if err := Diff(bytes.NewReader(cur), sig, &sink); err != nil {
+			t.Fatalf("%s: Diff: %v", name, err)
+		}
+		var out bytes.Buffer
+		err = Patch(bytes.NewReader(old), sig.BlockSize, sink.next(), &out)
+		if err != nil {
+			t.Fatalf("%s: Patch: %v", name, err)
+		}
+		if !bytes.Equal(out.Bytes(), cur) {
+			t.Errorf("%s: patched file differs from new version", name)
+		}
+
+		literal := 0
+		for _, op := range sink.ops {
+			literal += len(op.Data)
+		}
+		if name == "same" && literal != 0 {
+			t.Errorf("same: %d literal bytes sent for unchanged file", literal)
+		}
+		if name == "inserted" && literal > 777+2*int(sig.BlockSize) {
+			t.Errorf("inserted: %d literal bytes sent for 777 inserted", literal)
+		}
+	}
+}
+
+func TestDiffBadBlockSize(t *testing.T) {
+	for _, bs := range []uint32{0, 1, MinBlockSize - 1, MaxBlockSize + 1, 0xffffffff} {
+		sig := &ssproto.Signature{BlockSize: bs}
+		err := Diff(bytes.NewReader([]byte("data")), sig, &opSink{})
+		if err != ErrBadBlockSize {
+			t.Errorf("block size %d: got %v, want ErrBadBlockSize", bs, err)
+		}
+	}
+}
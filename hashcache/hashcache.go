@@ -0,0 +1,169 @@
+// hashcache.go - persistent cache of file hashes
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// Package hashcache remembers hashes of files between runs, so only files
+// whose size, modification time or inode changed need to be read again.
+package hashcache
+
+import (
+	"encoding/gob"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Files modified less than racyInterval ago are not cached: they may change
+// again without changing modification time on filesystems with coarse
+// timestamps.
+const racyInterval = 2 * time.Second
+
+type entry struct {
+	Size    int64
+	ModTime int64
+	Inode   uint64
+	Hash    ssproto.Hash
+
+	used bool
+}
+
+// Cache maps file paths to their hashes. It is safe for concurrent use.
+type Cache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// Open loads cache from file at path. Missing or damaged file results in
+// an empty cache, it will be created by Save.
+func Open(path string) *Cache {
+	c := &Cache{path: path, entries: make(map[string]*entry)}
+	f, err := os.Open(path)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&c.entries); err != nil {
+		c.entries = make(map[string]*entry)
+	}
+	return c
+}
+
+// Path returns location of the cache file.
+func (c *Cache) Path() string {
+	return c.path
+}
+
+// Reset forgets all cached hashes, so every file is hashed again.
+func (c *Cache) Reset() {
+	c.mu.Lock()
+	c.entries = make(map[string]*entry)
+	c.mu.Unlock()
+}
+
+// Hash returns BLAKE2b-256 hash and size of a file. File is read only if it
+// changed since it was hashed last time. A nil Cache hashes every time.
+func (c *Cache) Hash(path string) (ssproto.Hash, int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ssproto.Hash{}, 0, err
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return ssproto.Hash{}, 0, err
+	}
+	cur := entry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   inode(fi),
+	}
+
+	if c != nil {
+		c.mu.Lock()
+		e, ok := c.entries[key]
+		if ok && e.Size == cur.Size && e.ModTime == cur.ModTime && e.Inode == cur.Inode {
+			e.used = true
+			c.mu.Unlock()
+			return e.Hash, e.Size, nil
+		}
+		c.mu.Unlock()
+	}
+
+	hash, size, err := File(path)
+	if err != nil {
+		return hash, size, err
+	}
+	if c != nil && size == cur.Size && time.Since(fi.ModTime()) > racyInterval {
+		cur.Hash = hash
+		cur.used = true
+		c.mu.Lock()
+		c.entries[key] = &cur
+		c.mu.Unlock()
+	}
+	return hash, size, nil
+}
+
+// File computes BLAKE2b-256 hash and size of a file without loading it into
+// memory.
+func File(path string) (ssproto.Hash, int64, error) {
+	var res ssproto.Hash
+	f, err := os.Open(path)
+	if err != nil {
+		return res, 0, err
+	}
+	defer f.Close()
+	h, _ := blake2b.New256(nil)
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return res, 0, err
+	}
+	copy(res[:], h.Sum(nil))
+	return res, size, nil
+}
+
+// Save writes cache to its file. Only entries used since the cache was
+// opened are kept, so removed files don't stay there forever.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	used := make(map[string]*entry)
+	for k, e := range c.entries {
+		if e.used {
+			used[k] = e
+		}
+	}
+	c.mu.Unlock()
+
+	// Write to temporary file first, so interrupted save doesn't damage
+	// the cache.
+	if err := os.MkdirAll(filepath.Dir(c.path), 0775); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(used)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
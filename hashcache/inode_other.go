@@ -0,0 +1,24 @@
+// inode_other.go - file identity used to detect replaced files
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+//go:build !unix
+
+package hashcache
+
+import "os"
+
+// Windows doesn't report file index in os.FileInfo without opening the file,
+// size and modification time have to be enough there.
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,68 @@
+// pool.go - hashing many files in parallel
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package hashcache
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// Result is a hash of a single file computed by HashFiles.
+type Result struct {
+	// Index of the file in the list passed to HashFiles.
+	Index int
+	Path  string
+	Hash  ssproto.Hash
+	Size  int64
+	Err   error
+}
+
+// HashFiles hashes files at paths with a pool of workers, one per CPU core.
+// Each worker streams a single file at a time, so memory usage doesn't depend
+// on file sizes. done is called for each file in order of completion from the
+// calling goroutine. Like Hash, it works with nil Cache.
+func (c *Cache) HashFiles(paths []string, done func(Result)) {
+	workers := runtime.NumCPU()
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	jobs := make(chan int)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				res := Result{Index: idx, Path: paths[idx]}
+				res.Hash, res.Size, res.Err = c.Hash(res.Path)
+				results <- res
+			}
+		}()
+	}
+	go func() {
+		for i := range paths {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	for res := range results {
+		done(res)
+	}
+}
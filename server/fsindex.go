@@ -0,0 +1,506 @@
+// fsindex.go - enlisting and hashing of files that need to be present and up to date on client side.
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/ssproto"
+	"github.com/fsnotify/fsnotify"
+	"github.com/tevino/abool"
+)
+
+// IndexRule describes a file or directory that must be indexed.
+type IndexRule struct {
+	Path string `toml:"path"`
+
+	// ClientPath determines where the file must be stored on a client side.
+	// If this string begins with !, resulting client path will be Path with stripped ClientPath prefix.
+	ClientPath string `toml:"client_path"`
+
+	// Sync defines whether file must be kept in sync with client.
+	// false means that file must be present on client but is NOT required to be in sync
+	Sync bool `toml:"mandatory"`
+
+	// Recursive determines whether specified path must be indexed recursively.
+	// This has no effect on files.
+	Recursive bool `toml:"recursive"`
+}
+
+// FSIndex is a FileSource that serves files from local filesystem according
+// to a list of IndexRule. Changes on disk are tracked with fsnotify and
+// changed files are reindexed either when client connects or a few seconds
+// after last change.
+type FSIndex struct {
+	rules []IndexRule
+	// A collection of snowflakes! ❄️
+	// ignored contains files that must not be indexed and sent to client.
+	ignored []string
+	log     *log.Logger
+	cache   *hashcache.Cache
+
+	// OnReindex, if not nil, is called after each index rebuild.
+	OnReindex func()
+
+	filesMap        map[string]IndexedFile // indexed by client path!
+	filesMapLock    sync.RWMutex
+	timerLock       sync.Mutex
+	reindexTimer    *time.Timer
+	reindexRequired *abool.AtomicBool
+	watcher         *fsnotify.Watcher
+	// Absolute paths added to watcher, so they can be removed when rules
+	// change. Guarded by filesMapLock.
+	watched map[string]struct{}
+
+	// Paths changed since last rebuild and whether the index must be
+	// rebuilt from scratch instead. Guarded by filesMapLock.
+	pending     map[string]struct{}
+	fullRebuild bool
+	// Files found during indexing which are not hashed yet.
+	queue []IndexedFile
+
+	// Rules passed to SetRules, applied by next rebuild. Guarded by
+	// rulesLock.
+	rulesLock    sync.Mutex
+	nextRules    []IndexRule
+	nextIgnored  []string
+	rulesChanged bool
+}
+
+// FSIndexOption configures an FSIndex.
+type FSIndexOption func(*FSIndex)
+
+// WithHashCache makes index take hashes of unchanged files from c instead of
+// reading them. The cache is saved after each reindexing.
+func WithHashCache(c *hashcache.Cache) FSIndexOption {
+	return func(idx *FSIndex) {
+		idx.cache = c
+	}
+}
+
+// NewFSIndex builds an index of files described by rules and starts watching
+// them for changes. Paths containing any of ignored strings are skipped.
+// If logger is nil, standard logger is used.
+func NewFSIndex(rules []IndexRule, ignored []string, logger *log.Logger, opts ...FSIndexOption) (*FSIndex, error) {
+	if logger == nil {
+		logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	idx := &FSIndex{
+		rules:           rules,
+		ignored:         ignored,
+		log:             logger,
+		filesMap:        make(map[string]IndexedFile),
+		pending:         make(map[string]struct{}),
+		reindexRequired: abool.New(),
+		watcher:         watcher,
+		watched:         make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(idx)
+	}
+	idx.ListFiles()
+	idx.saveCache()
+	go idx.handleFSEvents()
+	return idx, nil
+}
+
+// Close stops watching indexed files for changes.
+func (idx *FSIndex) Close() error {
+	return idx.watcher.Close()
+}
+
+// Files implements FileSource. Pending reindexing, if any, is forced before
+// returning so caller will not get a hash of older file version.
+func (idx *FSIndex) Files() (map[string]IndexedFile, func()) {
+	if idx.reindexRequired.IsSet() {
+		idx.filesMapLock.Lock()
+		idx.rebuild()
+		idx.filesMapLock.Unlock()
+	}
+	idx.filesMapLock.RLock()
+	return idx.filesMap, idx.filesMapLock.RUnlock
+}
+
+// SetRules replaces index rules and ignore list. Index is rebuilt from scratch
+// the same way as after changes on disk, sessions which use current files are
+// not affected. SetRules doesn't wait for the rebuild.
+func (idx *FSIndex) SetRules(rules []IndexRule, ignored []string) {
+	idx.rulesLock.Lock()
+	idx.nextRules = rules
+	idx.nextIgnored = ignored
+	idx.rulesChanged = true
+	idx.rulesLock.Unlock()
+	idx.log.Println("Index rules changed, reindexing scheduled.")
+	idx.scheduleRebuild()
+}
+
+// applyRules switches to rules passed to SetRules, if any. filesMapLock must
+// be held for writing.
+func (idx *FSIndex) applyRules() {
+	idx.rulesLock.Lock()
+	defer idx.rulesLock.Unlock()
+	if !idx.rulesChanged {
+		return
+	}
+	idx.rules = idx.nextRules
+	idx.ignored = idx.nextIgnored
+	idx.rulesChanged = false
+	// Rebuild watches whatever new rules need.
+	for path := range idx.watched {
+		idx.watcher.Remove(path)
+	}
+	idx.watched = make(map[string]struct{})
+	idx.fullRebuild = true
+}
+
+// Open implements FileSource.
+func (idx *FSIndex) Open(file IndexedFile) (io.ReadCloser, error) {
+	return os.Open(file.ServPath)
+}
+
+func (idx *FSIndex) saveCache() {
+	if idx.cache == nil {
+		return
+	}
+	if err := idx.cache.Save(); err != nil {
+		idx.log.Println("Failed to save hash cache:", err)
+	}
+}
+
+// add puts file to the index unless clients would refuse its path.
+func (idx *FSIndex) add(f IndexedFile) {
+	if err := ssproto.CheckPath(ssproto.ToWire(f.ClientPath)); err != nil {
+		idx.log.Println("Skipping", f.ServPath+":", err)
+		return
+	}
+	idx.filesMap[f.ClientPath] = f
+}
+
+func (idx *FSIndex) index(rule IndexRule) error {
+	fi, err := os.Stat(rule.Path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		idx.watch(filepath.Dir(rule.Path))
+		return idx.indexFile(rule, rule.Path, fi)
+	}
+	return idx.indexDir(rule, rule.Path)
+}
+
+// indexDir indexes files in dir, which is either rule.Path or one of its
+// subdirectories.
+func (idx *FSIndex) indexDir(rule IndexRule, dir string) error {
+	idx.watch(dir)
+	if rule.Recursive {
+		return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if path != dir {
+					idx.watch(path)
+				}
+				return nil
+			}
+			return idx.indexFile(rule, path, info)
+		})
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := idx.indexFile(rule, filepath.Join(dir, f.Name()), f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (idx *FSIndex) isIgnored(path string) bool {
+	if strings.Contains(path, "ignored_") {
+		return true
+	}
+	for _, v := range idx.ignored {
+		if strings.Contains(path, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexFile queues a single file matched by rule for hashing, see
+// hashQueued. Files listed explicitly in rules are never ignored.
+func (idx *FSIndex) indexFile(rule IndexRule, path string, info os.FileInfo) error {
+	clientPath := rule.ClientPath
+	if path != rule.Path {
+		if idx.isIgnored(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(rule.Path, path)
+		if err != nil {
+			return err
+		}
+		clientPath = filepath.Join(rule.ClientPath, rel)
+	}
+
+	idx.queue = append(idx.queue, IndexedFile{
+		ServPath:         path,
+		ClientPath:       clientPath,
+		Mode:             info.Mode().Perm(),
+		ShouldNotReplace: !rule.Sync,
+	})
+	return nil
+}
+
+// hashQueued hashes all files queued by indexFile in parallel and puts them
+// to the index.
+func (idx *FSIndex) hashQueued() {
+	paths := make([]string, len(idx.queue))
+	for i, f := range idx.queue {
+		paths[i] = f.ServPath
+	}
+	idx.cache.HashFiles(paths, func(r hashcache.Result) {
+		if r.Err != nil {
+			idx.log.Println("Something went wrong during indexing:", r.Err)
+			return
+		}
+		f := idx.queue[r.Index]
+		f.Hash, f.Size = r.Hash, r.Size
+		idx.add(f)
+	})
+	idx.queue = nil
+}
+
+// within reports whether path is root or is located inside of it. Both paths
+// must be absolute and clean.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// isRuleDir reports whether path is a directory listed in rules or it's a
+// rule path which doesn't exist anymore. Changes of such paths require full
+// index rebuild.
+func (idx *FSIndex) isRuleDir(path string) bool {
+	for _, rule := range idx.rules {
+		abs, err := filepath.Abs(rule.Path)
+		if err != nil || abs != path {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil || fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// update brings index entries for a single changed absolute path up to date:
+// entries for files at or under path are dropped and whatever exists there
+// now is indexed again according to matching rules.
+func (idx *FSIndex) update(path string) {
+	for k, f := range idx.filesMap {
+		abs, err := filepath.Abs(f.ServPath)
+		if err == nil && within(path, abs) {
+			delete(idx.filesMap, k)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		// Removed or renamed, nothing to add.
+		return
+	}
+	for _, rule := range idx.rules {
+		root, err := filepath.Abs(rule.Path)
+		if err != nil || !within(root, path) {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			continue
+		}
+		// Keep paths in the same form as index does.
+		servPath := filepath.Join(rule.Path, rel)
+
+		switch {
+		case rel == ".":
+			// Directories listed in rules are handled by full rebuild.
+			if !info.IsDir() {
+				err = idx.indexFile(rule, servPath, info)
+			}
+		case !rule.Recursive && filepath.Dir(rel) != ".":
+		case info.IsDir():
+			if rule.Recursive && !idx.isIgnored(servPath) {
+				err = idx.indexDir(rule, servPath)
+			}
+		default:
+			err = idx.indexFile(rule, servPath, info)
+		}
+		if err != nil {
+			idx.log.Println("Something went wrong during indexing:", err)
+		}
+	}
+}
+
+// ListFiles processes files queued for indexing in server config
+func (idx *FSIndex) ListFiles() {
+	for _, v := range idx.rules {
+		err := idx.index(v)
+		if err != nil {
+			idx.log.Println("Something went wrong during indexing:", err)
+		}
+	}
+	idx.hashQueued()
+}
+
+// rebuild applies pending changes to the index if there are any.
+// filesMapLock must be held for writing.
+func (idx *FSIndex) rebuild() {
+	if !idx.reindexRequired.IsSet() {
+		return
+	}
+	// SetRules may schedule another rebuild while this one is running.
+	idx.timerLock.Lock()
+	idx.reindexTimer.Stop()
+	idx.reindexRequired.UnSet()
+	idx.timerLock.Unlock()
+	idx.applyRules()
+	if idx.fullRebuild {
+		idx.log.Println("Reindexing files...")
+		idx.filesMap = make(map[string]IndexedFile)
+		idx.ListFiles()
+	} else {
+		idx.log.Println("Updating index for", len(idx.pending), "changed paths...")
+		for path := range idx.pending {
+			idx.update(path)
+		}
+		idx.hashQueued()
+	}
+	if idx.OnReindex != nil {
+		idx.OnReindex()
+	}
+	idx.saveCache()
+	idx.log.Println("Reindexing done")
+	idx.pending = make(map[string]struct{})
+	idx.fullRebuild = false
+}
+
+func (idx *FSIndex) watch(path string) {
+	// We will catch changes in all files in directory we watch.
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		idx.log.Println("Failed to convert to abs path:", err)
+		return
+	}
+	if err := idx.watcher.Add(abs); err != nil {
+		idx.log.Println("Failed to add watcher for", abs+":", err)
+		return
+	}
+	idx.watched[abs] = struct{}{}
+}
+
+func (idx *FSIndex) processFsnotifyEvent(ev fsnotify.Event) {
+	idx.log.Println("fsnotify event", ev)
+
+	if ev.Op == fsnotify.Chmod {
+		if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+			return
+		}
+	}
+
+	if ev.Op&fsnotify.Remove == fsnotify.Remove {
+		idx.log.Println("File/directory removed:", ev.Name)
+		// We don't know if this was a directory or not.
+		// However try to remove it from watcher just in case.
+		idx.watcher.Remove(ev.Name)
+	}
+
+	// If something creates files x, y, z we will get separate event for each,
+	// so instead of updating index right away we remember changed paths and
+	// update it later (either when client connects or after 5 seconds).
+	// New directories are indexed (and watched, since fsnotify doesn't
+	// support recursive watching) as a whole then.
+	if !idx.reindexRequired.IsSet() {
+		idx.log.Println("Reindexing scheduled.")
+	}
+
+	idx.filesMapLock.Lock()
+	defer idx.filesMapLock.Unlock()
+	if idx.isRuleDir(ev.Name) {
+		idx.fullRebuild = true
+	} else {
+		idx.pending[ev.Name] = struct{}{}
+	}
+	idx.scheduleRebuild()
+}
+
+// scheduleRebuild makes index rebuilt either when client connects or after 5
+// seconds.
+func (idx *FSIndex) scheduleRebuild() {
+	idx.timerLock.Lock()
+	defer idx.timerLock.Unlock()
+	if idx.reindexTimer == nil {
+		idx.reindexTimer = time.NewTimer(5 * time.Second)
+		go idx.deferredIndexRebuild()
+	}
+	idx.reindexTimer.Reset(5 * time.Second)
+	idx.reindexRequired.Set()
+}
+
+func (idx *FSIndex) deferredIndexRebuild() {
+	for {
+		<-idx.reindexTimer.C
+		idx.filesMapLock.Lock()
+		idx.rebuild()
+		idx.filesMapLock.Unlock()
+	}
+}
+
+func (idx *FSIndex) handleFSEvents() {
+	for {
+		select {
+		case ev, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			idx.processFsnotifyEvent(ev)
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			idx.log.Println("fsnotify error:", err)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// limits.go - limiting concurrent sessions and connections per address
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// Limits protect server from being overloaded when many clients connect at
+// once. Zero values mean no limit.
+type Limits struct {
+	// MaxSessions is how many clients are served at once. Others wait in a
+	// queue and, if they support ssproto.CapQueue, are told their position.
+	MaxSessions int `toml:"max_sessions"`
+	// MaxQueue is how many clients may wait for a session, connections
+	// beyond that are closed right away.
+	MaxQueue int `toml:"max_queue"`
+
+	// MaxPerIP is how many connections one IP address may have open.
+	MaxPerIP int `toml:"max_per_ip"`
+	// IPRate is how many new connections per minute one IP address may open.
+	// Bursts of the same size are allowed.
+	IPRate int `toml:"ip_rate"`
+
+	// Bandwidth caps total upload speed in bytes per second. Sessions share
+	// it equally.
+	Bandwidth int64 `toml:"bandwidth"`
+	// SessionBandwidth caps upload speed of each session in bytes per second.
+	SessionBandwidth int64 `toml:"session_bandwidth"`
+}
+
+// WithLimits sets limits on sessions, connections and bandwidth. By default
+// there are none.
+func WithLimits(l Limits) Option {
+	return func(s *Server) {
+		s.limits = l
+	}
+}
+
+var errQueueFull = errors.New("server: wait queue is full")
+
+// sessionQueue admits at most max sessions at once, others wait in FIFO
+// order.
+type sessionQueue struct {
+	max        int
+	maxWaiting int
+
+	mtx     sync.Mutex
+	active  int
+	waiting []*queued
+}
+
+// queued is a session waiting in sessionQueue. Its position is sent over pos,
+// 0 when the session is admitted. Only the latest position is kept.
+type queued struct {
+	pos chan int
+}
+
+// update replaces position not received yet. sessionQueue.mtx must be held.
+func (w *queued) update(pos int) {
+	select {
+	case <-w.pos:
+	default:
+	}
+	w.pos <- pos
+}
+
+// wait blocks until a session may start. report, if not nil, is called with
+// queue position each time it changes and at least every
+// ssproto.QueueKeepAlive. Waiting stops when ctx is done, closing is closed or
+// report fails. Admitted sessions must call done when they finish.
+func (q *sessionQueue) wait(ctx context.Context, closing <-chan struct{}, report func(pos int) error) error {
+	q.mtx.Lock()
+	if q.max == 0 || (q.active < q.max && len(q.waiting) == 0) {
+		q.active++
+		q.mtx.Unlock()
+		return nil
+	}
+	if q.maxWaiting != 0 && len(q.waiting) >= q.maxWaiting {
+		q.mtx.Unlock()
+		return errQueueFull
+	}
+	w := &queued{pos: make(chan int, 1)}
+	q.waiting = append(q.waiting, w)
+	w.update(len(q.waiting))
+	q.mtx.Unlock()
+
+	keepAlive := time.NewTicker(ssproto.QueueKeepAlive)
+	defer keepAlive.Stop()
+	pos := 0
+	for {
+		var err error
+		select {
+		case pos = <-w.pos:
+			if pos == 0 {
+				return nil
+			}
+			if report != nil {
+				err = report(pos)
+			}
+		case <-keepAlive.C:
+			if report != nil {
+				err = report(pos)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-closing:
+			err = ErrServerClosed
+		}
+		if err != nil {
+			q.leave(w)
+			return err
+		}
+	}
+}
+
+// leave removes w from the queue. If it was admitted meanwhile, the slot is
+// passed on.
+func (q *sessionQueue) leave(w *queued) {
+	q.mtx.Lock()
+	for i, other := range q.waiting {
+		if other == w {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.updatePositions(i)
+			q.mtx.Unlock()
+			return
+		}
+	}
+	q.mtx.Unlock()
+	q.done()
+}
+
+// done frees the slot of finished session for the first waiting one.
+func (q *sessionQueue) done() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.waiting) == 0 {
+		q.active--
+		return
+	}
+	next := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	next.update(0)
+	q.updatePositions(0)
+}
+
+// updatePositions tells sessions waiting starting from index from their new
+// positions. mtx must be held.
+func (q *sessionQueue) updatePositions(from int) {
+	for i := from; i < len(q.waiting); i++ {
+		q.waiting[i].update(i + 1)
+	}
+}
+
+// ipLimiter limits number of connections and rate of new connections from
+// each IP address.
+type ipLimiter struct {
+	maxConns int
+	// New connections per minute.
+	rate int
+
+	mtx       sync.Mutex
+	clients   map[string]*ipState
+	lastPrune time.Time
+}
+
+type ipState struct {
+	conns int
+	// Connections allowed right now, refilled at rate up to rate.
+	tokens float64
+	last   time.Time
+}
+
+// acquire reports whether a new connection from ip is allowed and counts it.
+// Allowed connections must be released.
+func (l *ipLimiter) acquire(ip string) bool {
+	if l.maxConns == 0 && l.rate == 0 {
+		return true
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	now := time.Now()
+	l.prune(now)
+
+	st, ok := l.clients[ip]
+	if !ok {
+		st = &ipState{tokens: float64(l.rate), last: now}
+		l.clients[ip] = st
+	}
+	if l.rate != 0 {
+		st.tokens += now.Sub(st.last).Minutes() * float64(l.rate)
+		if st.tokens > float64(l.rate) {
+			st.tokens = float64(l.rate)
+		}
+		st.last = now
+		if st.tokens < 1 {
+			return false
+		}
+	}
+	if l.maxConns != 0 && st.conns >= l.maxConns {
+		return false
+	}
+	if l.rate != 0 {
+		st.tokens--
+	}
+	st.conns++
+	return true
+}
+
+// release forgets a connection counted by acquire.
+func (l *ipLimiter) release(ip string) {
+	if l.maxConns == 0 && l.rate == 0 {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if st, ok := l.clients[ip]; ok {
+		st.conns--
+	}
+}
+
+// prune forgets addresses without connections which got all tokens back,
+// at most once a minute. mtx must be held.
+func (l *ipLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for ip, st := range l.clients {
+		if st.conns == 0 && now.Sub(st.last) >= time.Minute {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// remoteIP returns IP address part of addr.
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
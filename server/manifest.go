@@ -0,0 +1,76 @@
+// manifest.go - release manifests describing served files
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// NewManifest creates release manifest listing files. It must be signed with
+// ssproto.SignManifest before use, preferably on a machine other than the
+// server.
+func NewManifest(files map[string]IndexedFile) *ssproto.Manifest {
+	m := &ssproto.Manifest{Timestamp: time.Now().Unix()}
+	for _, f := range files {
+		m.Entries = append(m.Entries, ssproto.ManifestEntry{
+			Path: ssproto.ToWire(f.ClientPath),
+			Hash: f.Hash,
+			Size: uint64(f.Size),
+			Mode: uint32(f.Mode.Perm()),
+		})
+	}
+	return m
+}
+
+// CheckManifest returns client paths of files which are not described by m
+// correctly. Clients verifying the manifest will refuse to download them.
+func CheckManifest(files map[string]IndexedFile, m *ssproto.Manifest) []string {
+	var res []string
+	for _, f := range files {
+		entry, ok := m.Lookup(ssproto.ToWire(f.ClientPath))
+		if !ok || entry.Hash != f.Hash || entry.Size != uint64(f.Size) {
+			res = append(res, f.ClientPath)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// LoadManifest reads signed manifest from file. Signature is not checked,
+// server doesn't need to know the key.
+func LoadManifest(path string) (*ssproto.SignedManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ssproto.NewDecoder(f).ReadManifest()
+}
+
+// SaveManifest writes signed manifest to file.
+func SaveManifest(path string, m *ssproto.SignedManifest) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = ssproto.NewEncoder(f).WriteManifest(m)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,62 @@
+// profile.go - several sets of files served by one server
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import "github.com/Hexawolf/SSProto/ssproto"
+
+// Profile is one of several sets of files served by the same server, along
+// with everything clients need to know about them.
+type Profile struct {
+	// Name reported to clients.
+	Name     string
+	Files    FileSource
+	Manifest *ssproto.SignedManifest
+	Managed  []ssproto.ManagedDir
+	// Channels of the profile, may be nil.
+	Channels Channels
+}
+
+// Profiles picks a profile for a client. Implementations must be safe for
+// concurrent use.
+type Profiles interface {
+	// Profile returns profile client id should be served from. name is the
+	// profile client requested, empty if it didn't. ok is false if there is
+	// no suitable profile.
+	Profile(name string, id ssproto.UUID) (p Profile, ok bool)
+}
+
+// ProfileSet is a Profiles implementation backed by maps. It must not be
+// modified while server is running.
+type ProfileSet struct {
+	// Profiles by name. Name field of each profile is set by ProfileSet.
+	Profiles map[string]Profile
+	// Default is a name of profile served to clients which don't request
+	// any. If it's empty, they get files set with WithFileSource.
+	Default string
+	// Overrides assign profiles to particular clients regardless of what
+	// they request.
+	Overrides map[ssproto.UUID]string
+}
+
+// Profile implements Profiles.
+func (ps *ProfileSet) Profile(name string, id ssproto.UUID) (Profile, bool) {
+	if override, ok := ps.Overrides[id]; ok {
+		name = override
+	}
+	if name == "" {
+		name = ps.Default
+	}
+	p, ok := ps.Profiles[name]
+	p.Name = name
+	return p, ok
+}
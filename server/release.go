@@ -0,0 +1,331 @@
+// release.go - immutable releases and channels pointing to them
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Channel is a set of files clients can request during handshake, see
+// ssproto.CapChannels.
+type Channel struct {
+	Files FileSource
+	// Manifest describing Files, may be nil.
+	Manifest *ssproto.SignedManifest
+	// Release is a name of the release reported to clients. It's empty if
+	// files are not a release.
+	Release string
+}
+
+// Channels looks up channels by name. Empty name is the default channel
+// served to clients which don't request any. Implementations must be safe
+// for concurrent use.
+type Channels interface {
+	Channel(name string) (Channel, bool)
+}
+
+// ErrReleaseExists is returned by ReleaseStore.Create when a release with
+// the same name already exists. Releases are never changed once created.
+var ErrReleaseExists = errors.New("server: release already exists")
+
+// ErrUnknownRelease is returned by ReleaseStore.SetChannels when a channel
+// points to a release which doesn't exist.
+type ErrUnknownRelease struct {
+	Channel string
+	Release string
+}
+
+func (e ErrUnknownRelease) Error() string {
+	return fmt.Sprintf("server: channel %q points to unknown release %q", e.Channel, e.Release)
+}
+
+// ErrChangedFile is returned by ReleaseStore.Create when file contents don't
+// match hash from the index anymore.
+type ErrChangedFile struct {
+	Path string
+}
+
+func (e ErrChangedFile) Error() string {
+	return fmt.Sprintf("server: %s changed since it was indexed", e.Path)
+}
+
+// Release is a named immutable set of files. It implements FileSource.
+type Release struct {
+	Name    string
+	Created time.Time
+	// Manifest describing the release, may be nil.
+	Manifest *ssproto.SignedManifest
+
+	files map[string]IndexedFile
+}
+
+// Files returns files of the release. They never change, so release func
+// does nothing.
+func (r *Release) Files() (map[string]IndexedFile, func()) {
+	return r.files, func() {}
+}
+
+// Open opens contents of a file of the release.
+func (r *Release) Open(file IndexedFile) (io.ReadCloser, error) {
+	return os.Open(file.ServPath)
+}
+
+// releaseFile is the on-disk format of a release.
+type releaseFile struct {
+	Created  time.Time
+	Files    []IndexedFile
+	Manifest *ssproto.SignedManifest
+}
+
+// Files of ReleaseStore directory.
+const (
+	// File contents named by hex-encoded hash, shared by all releases.
+	releaseObjectsDir = "objects"
+	// Extension of release files, which are named after releases.
+	releaseExt = ".release"
+)
+
+// ReleaseStore keeps releases in a directory and maps channels to them.
+// Contents of files are copied into the store when a release is created, so
+// releases don't change when the files they were created from do. Each
+// version of a file is stored once no matter how many releases include it.
+type ReleaseStore struct {
+	dir string
+
+	mu       sync.RWMutex
+	releases map[string]*Release
+	channels map[string]string
+	// Names of releases being created.
+	creating map[string]struct{}
+}
+
+// OpenReleaseStore loads releases from dir, creating it if needed.
+func OpenReleaseStore(dir string) (*ReleaseStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, releaseObjectsDir), 0775); err != nil {
+		return nil, err
+	}
+	rs := &ReleaseStore{
+		dir:      dir,
+		releases: make(map[string]*Release),
+		channels: make(map[string]string),
+		creating: make(map[string]struct{}),
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+releaseExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range names {
+		name := strings.TrimSuffix(filepath.Base(path), releaseExt)
+		r, err := rs.load(name)
+		if err != nil {
+			return nil, fmt.Errorf("server: loading release %s: %v", name, err)
+		}
+		rs.releases[name] = r
+	}
+	return rs, nil
+}
+
+func (rs *ReleaseStore) objectPath(hash ssproto.Hash) string {
+	return filepath.Join(rs.dir, releaseObjectsDir, hex.EncodeToString(hash[:]))
+}
+
+func (rs *ReleaseStore) load(name string) (*Release, error) {
+	f, err := os.Open(filepath.Join(rs.dir, name+releaseExt))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rf releaseFile
+	if err := gob.NewDecoder(f).Decode(&rf); err != nil {
+		return nil, err
+	}
+	r := &Release{
+		Name:     name,
+		Created:  rf.Created,
+		Manifest: rf.Manifest,
+		files:    make(map[string]IndexedFile, len(rf.Files)),
+	}
+	for _, file := range rf.Files {
+		file.ServPath = rs.objectPath(file.Hash)
+		r.files[file.ClientPath] = file
+	}
+	return r, nil
+}
+
+// Create makes a new release from files currently served by src. manifest
+// may be nil; if it's not, it must describe the files.
+func (rs *ReleaseStore) Create(name string, src FileSource, manifest *ssproto.SignedManifest) (*Release, error) {
+	if err := ssproto.CheckName(name); err != nil {
+		return nil, err
+	}
+	// Name is reserved until the release is ready, so concurrent calls
+	// can't overwrite each other's release file.
+	rs.mu.Lock()
+	_, exists := rs.releases[name]
+	_, reserved := rs.creating[name]
+	if !exists && !reserved {
+		rs.creating[name] = struct{}{}
+	}
+	rs.mu.Unlock()
+	if exists || reserved {
+		return nil, ErrReleaseExists
+	}
+	defer func() {
+		rs.mu.Lock()
+		delete(rs.creating, name)
+		rs.mu.Unlock()
+	}()
+
+	// Contents are copied without holding files, so reindexing isn't
+	// blocked meanwhile. Files changed since are caught by store.
+	files, release := src.Files()
+	snapshot := make([]IndexedFile, 0, len(files))
+	for _, file := range files {
+		snapshot = append(snapshot, file)
+	}
+	release()
+
+	rf := releaseFile{Created: time.Now(), Manifest: manifest}
+	for _, file := range snapshot {
+		if err := rs.store(src, file); err != nil {
+			return nil, err
+		}
+		file.ServPath = ""
+		rf.Files = append(rf.Files, file)
+	}
+	sort.Slice(rf.Files, func(i, j int) bool {
+		return rf.Files[i].ClientPath < rf.Files[j].ClientPath
+	})
+
+	location := filepath.Join(rs.dir, name+releaseExt)
+	f, err := os.OpenFile(location+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewEncoder(f).Encode(rf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(location+".tmp", location)
+	}
+	if err != nil {
+		os.Remove(location + ".tmp")
+		return nil, err
+	}
+
+	r, err := rs.load(name)
+	if err != nil {
+		return nil, err
+	}
+	rs.mu.Lock()
+	rs.releases[name] = r
+	rs.mu.Unlock()
+	return r, nil
+}
+
+// store copies contents of file into the store unless they are there already.
+func (rs *ReleaseStore) store(src FileSource, file IndexedFile) error {
+	dst := rs.objectPath(file.Hash)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	in, err := src.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Other releases may be storing the same contents right now.
+	out, err := ioutil.TempFile(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	h, _ := blake2b.New256(nil)
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	var sum ssproto.Hash
+	copy(sum[:], h.Sum(nil))
+	if err == nil && sum != file.Hash {
+		err = ErrChangedFile{Path: file.ServPath}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Releases returns all releases from the oldest to the newest one.
+func (rs *ReleaseStore) Releases() []*Release {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	res := make([]*Release, 0, len(rs.releases))
+	for _, r := range rs.releases {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res
+}
+
+// SetChannels replaces mapping of channel names to release names. Empty
+// channel name sets the default channel. Either all channels are valid and
+// set, or none.
+func (rs *ReleaseStore) SetChannels(channels map[string]string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for channel, release := range channels {
+		if channel != "" && ssproto.CheckName(channel) != nil {
+			return ssproto.ErrBadName
+		}
+		if _, ok := rs.releases[release]; !ok {
+			return ErrUnknownRelease{Channel: channel, Release: release}
+		}
+	}
+	rs.channels = make(map[string]string, len(channels))
+	for channel, release := range channels {
+		rs.channels[channel] = release
+	}
+	return nil
+}
+
+// Channel returns release the channel points to.
+func (rs *ReleaseStore) Channel(name string) (Channel, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	release, ok := rs.channels[name]
+	if !ok {
+		return Channel{}, false
+	}
+	// SetChannels made sure the release exists.
+	r := rs.releases[release]
+	return Channel{Files: r, Manifest: r.Manifest, Release: r.Name}, true
+}
@@ -0,0 +1,426 @@
+// server.go - embeddable SSProto server that handles multiple connections
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// Package server implements SSProto update server which can be embedded into
+// other applications. Files served to clients are provided by a FileSource,
+// see FSIndex for a default implementation backed by a local filesystem.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// ClientInfo describes a client session for Hooks.
+type ClientInfo struct {
+	ID   ssproto.UUID
+	Addr net.Addr
+
+	// Profile and Release client is served from, see ssproto.Selection.
+	Profile string
+	Release string
+	// Version identifies contents of files served to the client, see
+	// FilesVersion. It's zero if client can't be served from profile and
+	// channel it requested.
+	Version ssproto.Hash
+
+	// HWInfo is a machine information blob reported by the client. It's
+	// only known to Served.
+	HWInfo []byte
+}
+
+// Hooks allow embedding application to observe and control client sessions.
+// Any of the functions may be nil.
+type Hooks struct {
+	// Accept is called after client sent its identifier and files to serve
+	// it were picked. Returning false rejects the update request. If nil,
+	// every client is accepted.
+	Accept func(info ClientInfo) bool
+
+	// Served is called after all files were sent to the client.
+	Served func(info ClientInfo)
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAddress sets an address to listen on if no listener was given.
+// Syntax: <ip>:<port>
+func WithAddress(addr string) Option {
+	return func(s *Server) {
+		s.addr = addr
+	}
+}
+
+// WithListener makes server accept connections from l instead of creating
+// its own TCP listener.
+func WithListener(l net.Listener) Option {
+	return func(s *Server) {
+		s.listener = l
+	}
+}
+
+// WithTLSConfig sets TLS configuration used for accepted connections. If it is
+// not set, connections are served as is, so listener must take care of
+// encryption itself.
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = conf
+	}
+}
+
+// WithFileSource sets the set of files served to clients.
+func WithFileSource(src FileSource) Option {
+	return func(s *Server) {
+		s.files = src
+	}
+}
+
+// WithLogger sets logger used by server. Standard logger is used by default.
+func WithLogger(l *log.Logger) Option {
+	return func(s *Server) {
+		s.log = l
+	}
+}
+
+// WithHooks sets session callbacks.
+func WithHooks(h Hooks) Option {
+	return func(s *Server) {
+		s.hooks = h
+	}
+}
+
+// WithCapabilities limits optional protocol features offered to clients. By
+// default every feature implemented by this package is offered.
+func WithCapabilities(caps ssproto.Capabilities) Option {
+	return func(s *Server) {
+		s.caps = caps & SupportedCapabilities
+	}
+}
+
+// WithManifest sets signed release manifest sent to clients. It must describe
+// files served by the FileSource, otherwise clients verifying it will refuse
+// the update. Servers without manifest don't offer CapManifest.
+func WithManifest(m *ssproto.SignedManifest) Option {
+	return func(s *Server) {
+		s.manifest = m
+	}
+}
+
+// WithManagedDirs sets directories on client side where files not served by
+// server are deleted. By default there are none, so clients never delete
+// anything (except clients talking to servers which don't support
+// ssproto.CapManagedDirs, see client.DefaultManaged). Paths are in wire format
+// and must pass ssproto.CheckPath, New fails otherwise.
+func WithManagedDirs(dirs []ssproto.ManagedDir) Option {
+	return func(s *Server) {
+		s.managed = dirs
+	}
+}
+
+// WithChannels lets clients choose a channel to be updated from (see
+// ssproto.CapChannels). Clients which don't request a channel get the default
+// one if channels have it, otherwise they get files from WithFileSource and
+// manifest from WithManifest. Profiles have channels of their own.
+func WithChannels(c Channels) Option {
+	return func(s *Server) {
+		s.channels = c
+	}
+}
+
+// WithProfiles lets clients be served from different sets of files, see
+// Profile. Clients for which profiles has nothing get files, manifest, managed
+// directories and channels set with other options.
+func WithProfiles(p Profiles) Option {
+	return func(s *Server) {
+		s.profiles = p
+	}
+}
+
+// WithDrainTimeout sets how long Stop waits for active sessions to finish
+// before closing their connections. DefaultDrainTimeout is used by default.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.drainTimeout = d
+	}
+}
+
+// DefaultDrainTimeout is used by Stop unless WithDrainTimeout is given.
+const DefaultDrainTimeout = 30 * time.Second
+
+// SupportedCapabilities is a set of optional protocol features implemented
+// by this package.
+const SupportedCapabilities = ssproto.CapCompression | ssproto.CapDelta | ssproto.CapResume |
+	ssproto.CapMetadata | ssproto.CapManifest | ssproto.CapBatchVerdicts |
+	ssproto.CapManagedDirs | ssproto.CapChannels | ssproto.CapProfiles |
+	ssproto.CapQueue
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or
+// Stop was called.
+var ErrServerClosed = errors.New("server: server closed")
+
+// ErrNoFileSource is returned by New when neither FileSource nor Profiles
+// were configured.
+var ErrNoFileSource = errors.New("server: no file source configured")
+
+// Server encapsulates a group of goroutines processing active connections.
+// It provides functionality to start and stop the real TCP server itself and serve connections asynchronously.
+type Server struct {
+	addr      string
+	listener  net.Listener
+	tlsConfig *tls.Config
+	files     FileSource
+	log       *log.Logger
+	hooks     Hooks
+	caps      ssproto.Capabilities
+	manifest  *ssproto.SignedManifest
+	managed   []ssproto.ManagedDir
+	channels  Channels
+	profiles  Profiles
+
+	drainTimeout time.Duration
+
+	limits    Limits
+	queue     *sessionQueue
+	perIP     *ipLimiter
+	bandwidth *bandwidth
+
+	// ctx is cancelled when sessions must be stopped right away.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Listeners being served, closed on shutdown. Guarded by mtx.
+	listeners map[net.Listener]struct{}
+	closing   bool
+	// closed is closed on shutdown, so queued sessions stop waiting.
+	closed chan struct{}
+	mtx    sync.Mutex
+	// Active sessions.
+	wg sync.WaitGroup
+}
+
+// New creates a properly initialized Server object.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		addr: "0.0.0.0:" + strconv.Itoa(ssproto.Port),
+		log:  log.New(log.Writer(), log.Prefix(), log.Flags()),
+		caps: SupportedCapabilities,
+
+		drainTimeout: DefaultDrainTimeout,
+		listeners:    make(map[net.Listener]struct{}),
+		closed:       make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.files == nil && s.profiles == nil {
+		return nil, ErrNoFileSource
+	}
+	// Clients refuse the whole update if any of managed directories is
+	// unsafe.
+	if err := checkManaged(s.managed); err != nil {
+		return nil, err
+	}
+	if ps, ok := s.profiles.(*ProfileSet); ok {
+		for _, p := range ps.Profiles {
+			if err := checkManaged(p.Managed); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Channels and profiles may have manifests and channels of their own.
+	if s.manifest == nil && s.channels == nil && s.profiles == nil {
+		s.caps &^= ssproto.CapManifest
+	}
+	if s.channels == nil && s.profiles == nil {
+		s.caps &^= ssproto.CapChannels
+	}
+	if s.profiles == nil {
+		s.caps &^= ssproto.CapProfiles
+	}
+	if s.limits.MaxSessions == 0 {
+		s.caps &^= ssproto.CapQueue
+	}
+
+	s.queue = &sessionQueue{max: s.limits.MaxSessions, maxWaiting: s.limits.MaxQueue}
+	s.perIP = &ipLimiter{
+		maxConns: s.limits.MaxPerIP,
+		rate:     s.limits.IPRate,
+		clients:  make(map[string]*ipState),
+	}
+	if s.limits.Bandwidth > 0 {
+		s.bandwidth = &bandwidth{rate: s.limits.Bandwidth}
+	}
+	return s, nil
+}
+
+func checkManaged(dirs []ssproto.ManagedDir) error {
+	for _, m := range dirs {
+		if err := ssproto.CheckPath(m.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListenAndServe starts listening on configured address (unless listener was
+// given with WithListener) and serves incoming connections. It always returns
+// an error, ErrServerClosed after Shutdown.
+func (s *Server) ListenAndServe() error {
+	if s.listener == nil {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.listener = l
+	}
+	s.log.Println("Listening on", s.listener.Addr())
+	return s.Serve(s.listener)
+}
+
+// track adds listener to the set closed on shutdown or removes it from there.
+// It reports false if server is shutting down already.
+func (s *Server) track(listener net.Listener, add bool) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if !add {
+		delete(s.listeners, listener)
+		return true
+	}
+	if s.closing {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+// Serve accepts connections from listener and spawns a goroutine to serve each
+// one until Shutdown is called. Listener is closed when Serve returns. It
+// always returns an error, ErrServerClosed after Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	defer listener.Close()
+	if !s.track(listener, true) {
+		return ErrServerClosed
+	}
+	defer s.track(listener, false)
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			// Errors like running out of file descriptors go away when
+			// some connections are closed, wait for it.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.log.Println("Accept error:", err, "retrying in", delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		ip := remoteIP(conn.RemoteAddr())
+		if !s.perIP.acquire(ip) {
+			s.log.Println("Too many connections from", ip)
+			conn.Close()
+			continue
+		}
+		if !s.addSession() {
+			s.perIP.release(ip)
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.log.Println("Serving", conn.RemoteAddr())
+		conn = s.limitConn(conn)
+		if s.tlsConfig != nil {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+		go func() {
+			defer s.perIP.release(ip)
+			s.serve(s.ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) isClosing() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.closing
+}
+
+// addSession counts a new session unless server is shutting down. Shutdown
+// sets closing under the same lock before waiting, so sessions are never
+// added while it waits.
+func (s *Server) addSession() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closing {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// Shutdown stops accepting connections and waits for active sessions to
+// finish. If ctx is done first, connections of remaining sessions are closed
+// and ctx.Err() is returned once they exit.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mtx.Lock()
+	if !s.closing {
+		s.closing = true
+		close(s.closed)
+	}
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mtx.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.log.Println("Drain timeout exceeded, closing active connections")
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Stop is Shutdown with a drain timeout set by WithDrainTimeout. It blocks
+// until the server is really stopped.
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+	s.Shutdown(ctx)
+}
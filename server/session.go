@@ -0,0 +1,661 @@
+// session.go - does all the SSProto magic ✨
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/Hexawolf/SSProto/delta"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// session holds state of a single client connection.
+type session struct {
+	srv *Server
+	// ctx is cancelled when session must be stopped right away, its
+	// connection is closed then.
+	ctx  context.Context
+	conn net.Conn
+	enc  *ssproto.Encoder
+	dec  *ssproto.Decoder
+
+	// Negotiated protocol version and capabilities.
+	version uint8
+	caps    ssproto.Capabilities
+
+	id     ssproto.UUID
+	hwinfo []byte
+
+	// Profile and channel requested by client, empty if it didn't.
+	profile string
+	channel string
+
+	// Files served to this client, manifest describing them and managed
+	// directories, see selection.
+	files    FileSource
+	manifest *ssproto.SignedManifest
+	managed  []ssproto.ManagedDir
+
+	// Selection reply and version of files, see identify.
+	sel          ssproto.Selection
+	filesVersion ssproto.Hash
+
+	filesMap map[string]IndexedFile
+	// release unlocks filesMap, nil if files were not taken yet.
+	release func()
+	// Client files which are up to date.
+	clientFiles map[string]string
+	// All files reported by client.
+	clientList []string
+	// Client files we asked signatures of.
+	changed map[string]struct{}
+	// Signatures of client files we will send as delta, by client path.
+	signatures map[string]*ssproto.Signature
+	// Memory taken by signatures, see maxSignatureBytes.
+	signatureBytes int64
+	// Offsets to resume interrupted transfers from, by client path.
+	offsets map[string]uint64
+}
+
+func (s *Server) serve(ctx context.Context, conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	// Closing connection interrupts any read or write in progress.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sess := &session{
+		srv:         s,
+		ctx:         ctx,
+		conn:        conn,
+		enc:         ssproto.NewEncoder(conn),
+		dec:         ssproto.NewDecoder(conn),
+		clientFiles: make(map[string]string),
+		changed:     make(map[string]struct{}),
+		signatures:  make(map[string]*ssproto.Signature),
+		offsets:     make(map[string]uint64),
+	}
+
+	if err := sess.handshake(); err == errOutdatedClient {
+		s.log.Println("Outdated client", conn.RemoteAddr().String(), "told to update itself")
+		return
+	} else if err != nil {
+		s.log.Println("Stream error:", err)
+		return
+	}
+	s.log.Println("Protocol version", sess.version, "with capabilities:", sess.caps)
+
+	if err := sess.waitTurn(); err != nil {
+		s.log.Println("Not serving", conn.RemoteAddr().String()+":", err)
+		return
+	}
+	defer s.queue.done()
+
+	defer func() {
+		if sess.release != nil {
+			sess.release()
+		}
+	}()
+	accepted, err := sess.identify()
+	if err != nil {
+		s.log.Println("Stream error:", err)
+		return
+	}
+	baseEncodedID := base64.StdEncoding.EncodeToString(sess.id[:])
+	if !accepted {
+		s.log.Println("Rejecting connection from", baseEncodedID)
+		return
+	}
+
+	if sess.caps.Has(ssproto.CapManifest) {
+		if err := sess.enc.WriteManifest(sess.manifest); err != nil {
+			s.log.Println("Stream error:", err)
+			return
+		}
+	}
+
+	if sess.caps.Has(ssproto.CapManagedDirs) {
+		if err := sess.sendManagedDirs(); err != nil {
+			s.log.Println("Stream error:", err)
+			return
+		}
+	}
+
+	if err := sess.readHashList(); err != nil {
+		s.log.Println("Stream error:", err)
+		return
+	}
+
+	if sess.caps.Has(ssproto.CapDelta) {
+		if err := sess.readSignatures(); err != nil {
+			s.log.Println("Stream error:", err)
+			return
+		}
+	}
+
+	if sess.caps.Has(ssproto.CapResume) {
+		if err := sess.readResumeRequests(); err != nil {
+			s.log.Println("Stream error:", err)
+			return
+		}
+	}
+
+	if err := sess.sendFiles(); err != nil {
+		s.log.Println("Stream error:", err)
+		return
+	}
+
+	if s.hooks.Served != nil {
+		s.hooks.Served(sess.info())
+	}
+	// Logging virtual memory statistics received from the client to the log file
+	s.log.Println("HWInfo:", baseEncodedID+": "+string(sess.hwinfo))
+	s.log.Println("Success!")
+}
+
+// errOutdatedClient is returned by handshake for clients older than legacy
+// version. They only need to learn our version to update themselves.
+var errOutdatedClient = errors.New("server: client is older than legacy protocol")
+
+// handshake exchanges protocol versions and, since version 3, capabilities.
+// Legacy clients are answered with legacy version and served without any
+// optional features.
+func (s *session) handshake() error {
+	v, err := s.dec.ReadVersion()
+	if err != nil {
+		return err
+	}
+	if v == ssproto.VersionLegacy {
+		s.version = ssproto.VersionLegacy
+		return s.enc.WriteVersion(ssproto.VersionLegacy)
+	}
+
+	// Clients older than legacy will notice version mismatch and update
+	// themselves. Newer ones decide whether they can talk to us.
+	s.version = ssproto.Version
+	s.enc.SetVersion(s.version)
+	s.dec.SetVersion(s.version)
+	err = s.enc.WriteVersion(ssproto.Version)
+	if err != nil {
+		return err
+	}
+	if v < ssproto.Version {
+		return errOutdatedClient
+	}
+
+	clientCaps, err := s.dec.ReadCapabilities()
+	if err != nil {
+		return err
+	}
+	s.caps = clientCaps.Intersect(s.srv.caps)
+	err = s.enc.WriteCapabilities(s.caps)
+	if err != nil {
+		return err
+	}
+	s.enc.SetCapabilities(s.caps)
+	s.dec.SetCapabilities(s.caps)
+
+	// Requests are answered once we know who the client is.
+	if s.caps.Has(ssproto.CapChannels) {
+		if s.channel, err = s.dec.ReadChannelRequest(); err != nil {
+			return err
+		}
+	}
+	if s.caps.Has(ssproto.CapProfiles) {
+		if s.profile, err = s.dec.ReadProfileRequest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// info describes session for hooks.
+func (s *session) info() ClientInfo {
+	return ClientInfo{
+		ID:      s.id,
+		Addr:    s.conn.RemoteAddr(),
+		Profile: s.sel.Profile,
+		Release: s.sel.Release,
+		Version: s.filesVersion,
+		HWInfo:  s.hwinfo,
+	}
+}
+
+// waitTurn waits for a free session slot, telling client its position in the
+// queue if it supports that.
+func (s *session) waitTurn() error {
+	queued := false
+	report := func(pos int) error {
+		if !queued {
+			s.srv.log.Println("Client", s.conn.RemoteAddr(), "waits in queue at position", pos)
+			queued = true
+		}
+		if !s.caps.Has(ssproto.CapQueue) {
+			return nil
+		}
+		return s.enc.WriteQueuePosition(uint32(pos))
+	}
+	if err := s.srv.queue.wait(s.ctx, s.srv.closed, report); err != nil {
+		return err
+	}
+	if s.caps.Has(ssproto.CapQueue) {
+		if err := s.enc.WriteQueuePosition(0); err != nil {
+			s.srv.queue.done()
+			return err
+		}
+	}
+	return nil
+}
+
+// selection picks profile and channel to serve client from and sets files
+// accordingly.
+func (s *session) selection() ssproto.Selection {
+	srv := s.srv
+	p := Profile{
+		Files:    srv.files,
+		Manifest: srv.manifest,
+		Managed:  srv.managed,
+		Channels: srv.channels,
+	}
+	if srv.profiles != nil {
+		if found, ok := srv.profiles.Profile(s.profile, s.id); ok {
+			p = found
+		} else if s.profile != "" {
+			return ssproto.Selection{Status: ssproto.SelectionUnknownProfile}
+		}
+	}
+
+	ch := Channel{Files: p.Files, Manifest: p.Manifest}
+	if p.Channels != nil {
+		if found, ok := p.Channels.Channel(s.channel); ok {
+			ch = found
+		} else if s.channel != "" {
+			return ssproto.Selection{Status: ssproto.SelectionUnknownChannel}
+		}
+	}
+	if ch.Files == nil {
+		return ssproto.Selection{Status: ssproto.SelectionUnknownProfile}
+	}
+	// Client refuses updates without manifest anyway.
+	if s.caps.Has(ssproto.CapManifest) && ch.Manifest == nil {
+		return ssproto.Selection{Status: ssproto.SelectionNoManifest}
+	}
+
+	s.files = ch.Files
+	s.manifest = ch.Manifest
+	s.managed = p.Managed
+	return ssproto.Selection{Profile: p.Name, Release: ch.Release}
+}
+
+// errSelection is returned when client can't be served from profile and
+// channel it requested.
+type errSelection struct {
+	status           ssproto.SelectionStatus
+	profile, channel string
+}
+
+func (e errSelection) Error() string {
+	reason := "unknown profile"
+	switch e.status {
+	case ssproto.SelectionUnknownChannel:
+		reason = "unknown channel"
+	case ssproto.SelectionNoManifest:
+		reason = "no release manifest"
+	}
+	return fmt.Sprintf("server: can't serve profile %q, channel %q: %s", e.profile, e.channel, reason)
+}
+
+// sendSelection tells client which files were picked for it if it asked for
+// a profile or a channel.
+func (s *session) sendSelection() error {
+	sel := s.sel
+	if s.caps&(ssproto.CapChannels|ssproto.CapProfiles) != 0 {
+		if err := s.enc.WriteSelection(sel); err != nil {
+			return err
+		}
+	}
+	if sel.Status != ssproto.SelectionOK {
+		return errSelection{status: sel.Status, profile: s.profile, channel: s.channel}
+	}
+	if sel.Profile != "" || sel.Release != "" {
+		s.srv.log.Printf("Serving profile %q, release %q", sel.Profile, sel.Release)
+	}
+	return nil
+}
+
+// identify receives client UUID and machine information and picks files to
+// serve. accepted is false if the update request was rejected.
+func (s *session) identify() (accepted bool, err error) {
+	// Expecting 32-bytes long identifier
+	s.id, err = s.dec.ReadUUID()
+	if err != nil {
+		return false, err
+	}
+
+	// Files are picked before asking hooks, so they know what client would
+	// get.
+	s.sel = s.selection()
+	if s.sel.Status == ssproto.SelectionOK {
+		// Pending changes in file source (if any) are applied here, so we
+		// will not send newer version of file when we have only hash of
+		// older version.
+		s.filesMap, s.release = s.files.Files()
+		s.filesVersion = FilesVersion(s.filesMap)
+	}
+
+	hooks := s.srv.hooks
+	if hooks.Accept != nil && !hooks.Accept(s.info()) {
+		return false, s.enc.WriteBool(false)
+	}
+
+	err = s.enc.WriteBool(true)
+	if err != nil {
+		return false, err
+	}
+	if err := s.sendSelection(); err != nil {
+		return false, err
+	}
+	s.hwinfo, err = s.dec.ReadBlob()
+	return err == nil, err
+}
+
+// sendManagedDirs tells client where it should delete files we don't serve.
+func (s *session) sendManagedDirs() error {
+	for _, m := range s.managed {
+		if err := s.enc.WriteManagedDir(m); err != nil {
+			return err
+		}
+	}
+	return s.enc.WriteManagedDirsEnd()
+}
+
+// readHashList receives client hash-list and answers whether each file is
+// up to date.
+func (s *session) readHashList() error {
+	batch := s.caps.Has(ssproto.CapBatchVerdicts)
+	var verdicts []ssproto.Verdict
+
+	// Get hashes from client and create an intersection
+	for {
+		entry, end, err := s.dec.ReadHashListEntry()
+		if err != nil {
+			return err
+		}
+		if end {
+			break
+		}
+
+		// Construct client files list
+		s.clientList = append(s.clientList, entry.Path)
+
+		// Create intersection of client and server maps
+		verdict := ssproto.VerdictRemove
+		if v, ok := s.filesMap[entry.Path]; ok {
+			if v.Hash == entry.Hash {
+				verdict = ssproto.VerdictKeep
+				s.clientFiles[entry.Path] = v.ServPath
+			} else if s.caps.Has(ssproto.CapDelta) && !v.ShouldNotReplace {
+				// Client will send us a signature of this file.
+				verdict = ssproto.VerdictChanged
+				s.changed[entry.Path] = struct{}{}
+			}
+		}
+
+		if batch {
+			verdicts = append(verdicts, verdict)
+			continue
+		}
+		// Answer if file is valid
+		err = s.enc.WriteVerdict(verdict)
+		if err != nil {
+			return err
+		}
+	}
+	if batch {
+		return s.enc.WriteVerdicts(verdicts)
+	}
+	return nil
+}
+
+// maxSignatureBytes limits memory taken by signatures of a single session.
+// Files with signatures past the limit are sent whole.
+const maxSignatureBytes = 64 << 20
+
+// readSignatures receives signatures of files client has older versions of.
+// Signatures of files we didn't ask for, with bogus block size or describing
+// much more data than the new version has are dropped.
+func (s *session) readSignatures() error {
+	for {
+		sig, end, err := s.dec.ReadSignature()
+		if err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+		if _, ok := s.changed[sig.Path]; !ok {
+			continue
+		}
+		if delta.CheckBlockSize(sig.BlockSize) != nil {
+			continue
+		}
+		covered := int64(len(sig.Blocks)) * int64(sig.BlockSize)
+		if covered > 4*s.filesMap[sig.Path].Size+delta.MaxBlockSize {
+			continue
+		}
+		// Weak and strong checksum of each block.
+		size := int64(len(sig.Blocks)) * (4 + ssproto.StrongSize)
+		if s.signatureBytes+size > maxSignatureBytes {
+			continue
+		}
+		s.signatureBytes += size
+		s.signatures[sig.Path] = sig
+	}
+}
+
+// readResumeRequests receives offsets of interrupted transfers. Requests
+// for contents we don't serve anymore are dropped, so client gets the whole
+// new version.
+func (s *session) readResumeRequests() error {
+	for {
+		req, end, err := s.dec.ReadResumeRequest()
+		if err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+		v, ok := s.filesMap[req.Path]
+		if !ok || v.Hash != req.Hash || req.Offset > uint64(v.Size) {
+			continue
+		}
+		s.offsets[req.Path] = req.Offset
+	}
+}
+
+// changes returns files that must be sent to the client.
+func (s *session) changes() []IndexedFile {
+	// Remove difference from server files to create a list of mods that we need to send
+	changes := make(map[string]IndexedFile)
+	for _, v := range s.filesMap {
+		if _, ok := s.clientFiles[v.ClientPath]; ok {
+			continue
+		}
+		changes[v.ClientPath] = v
+	}
+
+	var res []IndexedFile
+	for _, entry := range changes {
+		skip := false
+		for _, clientFile := range s.clientList {
+			if clientFile == entry.ClientPath && entry.ShouldNotReplace {
+				skip = true
+			}
+		}
+		if skip {
+			continue
+		}
+		res = append(res, entry)
+	}
+	return res
+}
+
+// errSkipFile is returned by open when a file can't be sent to the client,
+// but the session can go on without it.
+var errSkipFile = errors.New("server: file skipped")
+
+// statter is implemented by file contents that know their size, like
+// *os.File.
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+// open opens contents of a file to be sent. Files which vanished or changed
+// size since they were indexed are skipped: client will get them during next
+// session, when index is up to date.
+func (s *session) open(entry IndexedFile) (io.ReadCloser, error) {
+	f, err := s.files.Open(entry)
+	if err != nil {
+		s.srv.log.Println("Failed to open file", entry.ServPath+":", err)
+		return nil, errSkipFile
+	}
+	if st, ok := f.(statter); ok {
+		fi, err := st.Stat()
+		if err != nil || fi.Size() != entry.Size {
+			s.srv.log.Println("File", entry.ServPath, "changed since indexing, skipping it")
+			f.Close()
+			return nil, errSkipFile
+		}
+	}
+	return f, nil
+}
+
+func (s *session) sendFiles() error {
+	for _, entry := range s.changes() {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		offset, resumed := s.offsets[entry.ClientPath]
+		var err error
+		if sig, ok := s.signatures[entry.ClientPath]; ok && !resumed {
+			err = s.sendDelta(entry, sig)
+		} else {
+			err = s.sendFile(entry, offset, resumed)
+		}
+		if err != nil && err != errSkipFile {
+			return err
+		}
+	}
+	return s.enc.WriteFilesEnd()
+}
+
+// sendFile streams file contents starting from offset. Only a small sample
+// of the file is kept in memory to decide whether to compress it.
+func (s *session) sendFile(entry IndexedFile, offset uint64, resumed bool) error {
+	f, err := s.open(entry)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if resumed {
+		// Offset was checked against indexed size in readResumeRequests.
+		_, err = io.CopyN(ioutil.Discard, f, int64(offset))
+		if err != nil {
+			s.srv.log.Println("Failed to read file", entry.ServPath+":", err)
+			return errSkipFile
+		}
+	}
+
+	var flags ssproto.FileFlags
+	if resumed {
+		flags |= ssproto.FlagResumed
+	}
+	var body io.Reader = f
+	if s.caps.Has(ssproto.CapCompression) {
+		sample := make([]byte, ssproto.CompressionSampleSize)
+		n, err := io.ReadFull(f, sample)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			s.srv.log.Println("Failed to read file", entry.ServPath+":", err)
+			return errSkipFile
+		}
+		sample = sample[:n]
+		if ssproto.ShouldCompress(sample) {
+			flags |= ssproto.FlagCompressed
+		}
+		body = io.MultiReader(bytes.NewReader(sample), f)
+	}
+
+	// Header is sent already if this fails, so the stream is broken and the
+	// client can't be served anymore.
+	return s.enc.WriteFile(ssproto.File{
+		Path:   entry.ClientPath,
+		Flags:  flags,
+		Size:   uint64(entry.Size),
+		Hash:   entry.Hash,
+		Offset: offset,
+		Body:   body,
+	})
+}
+
+// deltaSink writes operations produced by delta.Diff to the client.
+type deltaSink struct {
+	enc *ssproto.Encoder
+}
+
+func (d deltaSink) Copy(index uint64) error {
+	return d.enc.WriteDeltaOp(ssproto.DeltaOp{Code: ssproto.DeltaCopy, Index: index})
+}
+
+func (d deltaSink) Data(b []byte) error {
+	return d.enc.WriteDeltaOp(ssproto.DeltaOp{Code: ssproto.DeltaData, Data: b})
+}
+
+// sendDelta sends file as a difference from client version described by sig.
+func (s *session) sendDelta(entry IndexedFile, sig *ssproto.Signature) error {
+	f, err := s.open(entry)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = s.enc.WriteFileHeader(ssproto.File{
+		Path:  entry.ClientPath,
+		Flags: ssproto.FlagDelta,
+		Size:  uint64(entry.Size),
+		Hash:  entry.Hash,
+	})
+	if err != nil {
+		return err
+	}
+	err = delta.Diff(f, sig, deltaSink{s.enc})
+	if err != nil {
+		return err
+	}
+	return s.enc.WriteDeltaOp(ssproto.DeltaOp{Code: ssproto.DeltaEnd})
+}
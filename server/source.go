@@ -0,0 +1,73 @@
+// source.go - abstraction over the set of files served to clients
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"io"
+	"os"
+	"sort"
+
+	"github.com/Hexawolf/SSProto/ssproto"
+	"golang.org/x/crypto/blake2b"
+)
+
+// IndexedFile represents essential data shipped with the file during update.
+type IndexedFile struct {
+	// Where file is located on server. Meaning of this value is up to
+	// FileSource, for FSIndex this is a filesystem path.
+	ServPath string
+	// Where file should be placed on client (relative to client root directory).
+	ClientPath string
+
+	Hash ssproto.Hash
+	// Size of file contents in bytes.
+	Size int64
+	// Mode contains permission bits of the file.
+	Mode os.FileMode
+
+	// If true - file will be not replaced at client if it's already present
+	// (even if changed).
+	ShouldNotReplace bool
+}
+
+// FileSource is the set of files served to clients. Implementations must be
+// safe for concurrent use.
+type FileSource interface {
+	// Files returns served files indexed by client path. Returned map must
+	// stay unchanged until release is called, so one session sees a
+	// consistent state.
+	Files() (files map[string]IndexedFile, release func())
+
+	// Open opens contents of a file previously returned by Files.
+	Open(file IndexedFile) (io.ReadCloser, error)
+}
+
+// FilesVersion returns a hash identifying contents of files: it changes when
+// any file is added, removed or changed.
+func FilesVersion(files map[string]IndexedFile) ssproto.Hash {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	h, _ := blake2b.New256(nil)
+	for _, path := range paths {
+		hash := files[path].Hash
+		io.WriteString(h, ssproto.ToWire(path))
+		h.Write([]byte{0})
+		h.Write(hash[:])
+	}
+	var res ssproto.Hash
+	copy(res[:], h.Sum(nil))
+	return res
+}
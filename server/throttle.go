@@ -0,0 +1,117 @@
+// throttle.go - bandwidth limits and I/O timeouts of connections
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ioTimeout is how long a single read or write may take before connection is
+// considered dead.
+const ioTimeout = 300 * time.Second
+
+// throttleChunk is the largest write allowed at once by bandwidth limits.
+const throttleChunk = 16 * 1024
+
+// bandwidth hands out permission to send bytes at a limited rate. Senders
+// reserve one small chunk at a time, so concurrent ones are served in turn
+// and share the rate equally.
+type bandwidth struct {
+	// Bytes per second.
+	rate int64
+
+	mtx sync.Mutex
+	// When reserved bandwidth runs out.
+	next time.Time
+}
+
+// reserve returns how long to wait before sending n bytes.
+func (b *bandwidth) reserve(n int) time.Duration {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	wait := b.next.Sub(now)
+	b.next = b.next.Add(time.Duration(n) * time.Second / time.Duration(b.rate))
+	return wait
+}
+
+// limitedConn is a connection of a single session. Every read and write must
+// finish within ioTimeout and writes are throttled by bandwidth limits.
+type limitedConn struct {
+	net.Conn
+	ctx    context.Context
+	limits []*bandwidth
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(ioTimeout))
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(c.limits) != 0 && len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		// Session limit goes first, so its waiting doesn't waste shared
+		// bandwidth.
+		for _, l := range c.limits {
+			if err := sleep(c.ctx, l.reserve(len(chunk))); err != nil {
+				return written, err
+			}
+		}
+		c.Conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// sleep waits for d unless ctx is done earlier.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitConn applies I/O timeouts and bandwidth limits to a new connection.
+func (s *Server) limitConn(conn net.Conn) net.Conn {
+	lc := &limitedConn{Conn: conn, ctx: s.ctx}
+	if s.limits.SessionBandwidth > 0 {
+		lc.limits = append(lc.limits, &bandwidth{rate: s.limits.SessionBandwidth})
+	}
+	if s.bandwidth != nil {
+		lc.limits = append(lc.limits, s.bandwidth)
+	}
+	return lc
+}
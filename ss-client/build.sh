@@ -1,13 +1,19 @@
 #!/bin/sh
 
-if [ $# -ne 3 ]; then
-    echo "Usage: ./build.sh CERTIFICATE SERVER-ADDRESS FILENAME"
-    echo "E.g. ./build.sh cert.pem doggoat.de:48879 Updater"
+if [ $# -ne 3 ] && [ $# -ne 4 ]; then
+    echo "Usage: ./build.sh CERTIFICATE SERVER-ADDRESS FILENAME [MANIFEST-KEY]"
+    echo "E.g. ./build.sh cert.pem doggoat.de:48879 Updater release.pub"
+    echo "MANIFEST-KEY is a public key file created by ss-sign -genkey. If it's"
+    echo "given, updater refuses files not listed in signed release manifest."
     echo "Also you can use EXTRABUILDFLAGS envvar to specify additional"
     echo "arguments to pass to go build."
     exit 1
 fi
 
 cert=$(printf "%s" "$(< $1)" | head -n -1 | tail -n +2 | paste -s -d "")
+manifestKey=""
+if [ $# -eq 4 ]; then
+    manifestKey=$(cat $4)
+fi
 
-go build -o $3 --ldflags="-s -w -X main.certEnc=$cert -X main.targetHost=$2" $EXTRABUILDFLAGS
+go build -o $3 --ldflags="-s -w -X main.certEnc=$cert -X main.targetHost=$2 -X main.manifestKeyEnc=$manifestKey" $EXTRABUILDFLAGS
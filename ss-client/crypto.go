@@ -13,11 +13,10 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
-
-	"crypto/rand"
-	"io/ioutil"
+	"encoding/base64"
 	"strings"
 )
 
@@ -26,6 +25,13 @@ var conf tls.Config
 // Both variables are set by build script.
 var certEnc, keyEnc string
 
+// manifestKeyEnc is a base64-encoded public key release manifests are signed
+// with. It is set by build script, manifests are not checked if it's empty.
+var manifestKeyEnc string
+
+// manifestKey is decoded manifestKeyEnc.
+var manifestKey ed25519.PublicKey
+
 func init() {
 	certs := x509.NewCertPool()
 
@@ -40,25 +46,12 @@ func init() {
 		// Extract domain from targetHost
 		ServerName: strings.Split(targetHost, ":")[0],
 	}
-}
 
-func newUUID() ([]byte, error) {
-	v := make([]byte, 32)
-	_, err := rand.Read(v)
-	return v, err
-}
-
-// UUID tries to load from config/uuid.bin or generate a new random sequence of 32 bytes. This
-// sequence is used for client identification.
-func UUID() ([]byte, error) {
-	uuidLocation := "config/uuid.bin"
-	if fileExists(uuidLocation) {
-		return ioutil.ReadFile(uuidLocation)
-	}
-	b, err := newUUID()
-	if err != nil {
-		return nil, err
+	if manifestKeyEnc != "" {
+		key, err := base64.StdEncoding.DecodeString(manifestKeyEnc)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			panic("failed to load manifest key")
+		}
+		manifestKey = key
 	}
-	ioutil.WriteFile(uuidLocation, b, 0600)
-	return b, nil
 }
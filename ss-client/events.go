@@ -0,0 +1,97 @@
+// events.go - printing update progress to the console
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Hexawolf/SSProto/client"
+)
+
+// msgLength is a length of the last progress line printed, so shorter lines
+// can overwrite it completely.
+var msgLength int
+
+func printProgress(str string) {
+	if len(str) < msgLength {
+		str += strings.Repeat(" ", msgLength-len(str))
+	}
+	msgLength = len(str)
+	fmt.Print("\r" + str)
+}
+
+// endProgress moves to a new line after progress line, if any.
+func endProgress() {
+	if msgLength != 0 {
+		fmt.Println()
+		msgLength = 0
+	}
+}
+
+func handleEvent(ev client.Event) {
+	switch ev.(type) {
+	case client.Queued, client.FileProgress, client.FileReceived:
+	default:
+		endProgress()
+	}
+	switch ev := ev.(type) {
+	case client.Connected:
+		fmt.Println("Server protocol version:", ev.ServerVersion)
+		fmt.Println("Protocol features:", ev.Capabilities)
+	case client.Queued:
+		printProgress(fmt.Sprintf("Server is busy, waiting in queue (position %d)...", ev.Position))
+	case client.Rejected:
+		fmt.Println("Server rejected download request. " +
+			"Simply launching client for now.")
+	case client.Selected:
+		if ev.Profile != "" {
+			fmt.Println("Profile:", ev.Profile)
+		}
+		if ev.Release != "" {
+			fmt.Println("Release:", ev.Release)
+		}
+	case client.HashingProgress:
+		if ev.Hashed == ev.Total {
+			fmt.Println("Sending information about", ev.Total, "files...")
+		}
+	case client.FileRemoved:
+		if ev.Err != nil {
+			fmt.Printf("Failed to remove %v: %v\n", ev.Path, ev.Err)
+		} else if ev.Quarantine != "" {
+			fmt.Println("Moving to quarantine", ev.Path)
+		} else {
+			fmt.Println("Removing", ev.Path)
+		}
+	case client.FileProgress:
+		percent := 100
+		if ev.Size != 0 {
+			percent = int(float64(ev.Received) / float64(ev.Size) * 100)
+		}
+		printProgress(fmt.Sprintf("Receiving %s (%s of %s, %v%%)...",
+			ev.Path, humanReadableSize(ev.Received), humanReadableSize(ev.Size), percent))
+	case client.FileReceived:
+		printProgress(fmt.Sprintf("Received %s", ev.Path))
+		endProgress()
+	case client.RolledBack:
+		if ev.Err == client.ErrInterruptedCommit {
+			fmt.Println("Previous update was interrupted, restoring old files.")
+		} else {
+			fmt.Println("Update failed, restoring old files:", ev.Err)
+		}
+	case client.HistoryFailed:
+		fmt.Println("Failed to save previous versions of files:", ev.Err)
+	case client.Done:
+		fmt.Println("Connection closed.")
+	}
+}
@@ -14,32 +14,38 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
 	"encoding/base64"
-	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Hexawolf/SSProto/client"
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/ssproto"
 	"github.com/inconshreveable/go-update"
 )
 
-// SSProtoVersion is a protocol version. Used to determine if we need to update this application.
-const SSProtoVersion uint8 = 2
-
 // This variable is set by build.sh
 var targetHost string
 
 var noLaunch = false
 var forceCurrent = false
 var installDirectory string
+var rehash = false
+var restore = false
+var restoreName string
+var rollback = 0
+var channel string
+var profile string
 
 // launchClient tries to launch client startup script distributed with Hexamine client.
 // Notice for future generations: you likely want to get rid of this if you want reuse SSProto
@@ -115,6 +121,11 @@ func handleArgs() {
 		fmt.Println("--only-launch \t- Do not perform any updates, just launch the game.")
 		fmt.Println("--install-dir \"path\" \t- directory to install client.")
 		fmt.Println("--no-launch \t- Do not launch client after installation.")
+		fmt.Println("--rehash \t- Ignore cached hashes and hash all files again.")
+		fmt.Println("--restore [name] \t- Bring back files removed by the latest (or named) update and exit.")
+		fmt.Println("--rollback N \t- Undo the last N updates and launch the game without updating.")
+		fmt.Println("--channel name \t- Update from given release channel, like \"beta\".")
+		fmt.Println("--profile name \t- Update given modpack if server has several.")
 		fmt.Println("--copyright \t- License and copyright.")
 		fmt.Println("--help \t\t- this.")
 		os.Exit(0)
@@ -152,6 +163,52 @@ SOFTWARE.`)
 		noLaunch = true
 	}
 
+	if containsString(os.Args, "--rehash") {
+		rehash = true
+	}
+
+	if containsString(os.Args, "--restore") {
+		restore = true
+		index := posString(os.Args, "--restore") + 1
+		if index < len(os.Args) && !strings.HasPrefix(os.Args[index], "--") {
+			restoreName = os.Args[index]
+		}
+	}
+
+	if containsString(os.Args, "--rollback") {
+		index := posString(os.Args, "--rollback") + 1
+		n := 0
+		if index < len(os.Args) {
+			n, _ = strconv.Atoi(os.Args[index])
+		}
+		if n < 1 {
+			fmt.Println()
+			fmt.Println("Invalid usage!")
+			os.Exit(1)
+		}
+		rollback = n
+	}
+
+	if containsString(os.Args, "--channel") {
+		index := posString(os.Args, "--channel") + 1
+		if index >= len(os.Args) {
+			fmt.Println()
+			fmt.Println("Invalid usage!")
+			os.Exit(1)
+		}
+		channel = os.Args[index]
+	}
+
+	if containsString(os.Args, "--profile") {
+		index := posString(os.Args, "--profile") + 1
+		if index >= len(os.Args) {
+			fmt.Println()
+			fmt.Println("Invalid usage!")
+			os.Exit(1)
+		}
+		profile = os.Args[index]
+	}
+
 	if containsString(os.Args, "--install-dir") {
 		index := posString(os.Args, "--install-dir") + 1
 		if len(os.Args) < index {
@@ -237,173 +294,161 @@ func runSelfupdate() error {
 	return nil
 }
 
-func savePacket(p *Packet) error {
-	// Ensure all directories exist.
-	err := os.MkdirAll(filepath.Dir(p.FilePath), 0775)
-	if err != nil {
-		return err
-	}
+// updateAttempts is how many times we try to connect again if connection
+// drops or a file gets corrupted during update. Interrupted downloads
+// continue where they stopped.
+const updateAttempts = 3
 
-	f, err := os.Create(p.FilePath + ".new")
-	if err != nil {
-		return err
+// isTransientError reports whether err is caused by connection problems or
+// corrupted transfer, so another attempt may succeed.
+func isTransientError(err error) bool {
+	switch err.(type) {
+	case net.Error, client.ErrHashMismatch:
+		return true
 	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
 
-	err = copyWithProgress(p.FilePath, p.Size, p.Blob, f)
+// runUpdate connects to the server and performs a single update session.
+func runUpdate(c *client.Client) error {
+	session, err := c.Connect()
 	if err != nil {
-		f.Close()
-		os.Remove(p.FilePath + ".new")
+		if _, ok := err.(client.ErrVersionMismatch); ok {
+			fmt.Println(err)
+			if err := runSelfupdate(); err != nil {
+				Crash("runSelfupdate", err)
+			}
+		}
 		return err
 	}
+	defer session.Close()
 
-	f.Close()
+	fmt.Println("Hashing all files...")
+	return session.Update()
+}
 
-	err = os.Rename(p.FilePath+".new", p.FilePath)
-	if err != nil {
-		return err
+// runRestore moves quarantined files back into installation directory.
+func runRestore(c *client.Client) error {
+	restored, err := c.Restore(restoreName)
+	if os.IsNotExist(err) {
+		fmt.Println("No such quarantine:", restoreName)
+		names, err := c.Quarantined()
+		if err != nil {
+			return err
+		}
+		fmt.Println("Available:")
+		for _, name := range names {
+			fmt.Println("\t" + name)
+		}
+		return nil
 	}
-
-	return nil
+	for _, path := range restored {
+		fmt.Println("Restored", path)
+	}
+	if err == client.ErrNoQuarantine {
+		fmt.Println("Nothing to restore.")
+		return nil
+	}
+	return err
 }
 
-func removeExcessFiles(c *tls.Conn) error {
-	list, err := collectHashList()
+// runRollback undoes the last updates.
+func runRollback(c *client.Client) error {
+	history, err := c.History()
 	if err != nil {
 		return err
 	}
-	fmt.Println("Sending information about", len(list), "files...")
-
-	// Apply "changes" requested by server - delete excess files.
-	orderedList := make([]string, 0, len(list))
-	for k, v := range list {
-		err := SendHashListEntry(c, k, v)
-		if err != nil {
-			return err
-		}
-		orderedList = append(orderedList, k)
+	if rollback > len(history) {
+		fmt.Println("Only", len(history), "updates can be undone.")
+		return client.ErrHistoryTooShort
 	}
-	for _, path := range orderedList {
-		resp := true
-		err := binary.Read(c, binary.LittleEndian, &resp)
-		if err != nil {
-			return err
-		}
-
-		if !resp && filepath.Dir(path) == "mods" {
-			fmt.Println("Removing", path)
-			if err := os.Remove(path); err != nil {
-				fmt.Printf("Failed to remove %v: %v\n", path, err)
-			}
-		}
+	fmt.Println("Restoring files as they were before update of",
+		history[len(history)-rollback].Time.Format("2006-01-02 15:04:05"))
+	if err := c.Rollback(rollback); err != nil {
+		return err
 	}
+	fmt.Println("Done. Run updater with --only-launch to play without updating again.")
 	return nil
 }
 
 // main ✨✨✨
 func main() {
-	fmt.Println("SSProto, protocol version:", SSProtoVersion)
+	fmt.Println("SSProto, protocol version:", ssproto.Version)
 	fmt.Println("Copyright (C) Hexawolf 2018")
 
 	handleArgs()
 
-	fmt.Println("SSProto version:", SSProtoVersion)
-
-	c, err := tls.Dial("tcp", targetHost, &conf)
-	if err != nil {
-		fmt.Println("Unable to connect the update server.")
-		fmt.Println("If you really want to start Hexamine client without updating, " +
-			"run updater with --only-launch flag.")
-		Crash("tls.Dial", err)
-	}
-	defer c.Close()
-
-	defer time.Sleep(time.Second * 5)
+	fmt.Println("SSProto version:", ssproto.Version)
 
 	// Setting up directory
 	if err := prepareInstallDir(); err != nil {
 		Crash("prepareInstallDir", err)
 	}
 
-	// Check protocol version
-	{
-		err = binary.Write(c, binary.LittleEndian, SSProtoVersion)
-		if err != nil {
-			Crash("Unable to send SSProto version:", err.Error())
-		}
-		var pv uint8
-		err = binary.Read(c, binary.LittleEndian, &pv)
-		if err != nil {
-			Crash("Unable to read server protocol response:", err.Error())
-		}
-		fmt.Println("Server protocol version:", pv)
-		if pv != SSProtoVersion {
-			if err := runSelfupdate(); err != nil {
-				Crash("runSelfupdate", err)
-			}
-		}
-	}
+	defer time.Sleep(time.Second * 5)
 
-	// Generate new UUID/load saved UUID.
-	uuid, err := UUID()
+	// Server can't touch updater state, so it can't make stale files look
+	// current by sending a crafted cache.
+	cache := hashcache.Open(filepath.Join(client.StateDir, "hashcache.bin"))
+	// Older versions kept the cache where server could see it.
+	os.Remove(filepath.Join("config", "hashcache.bin"))
+	if rehash {
+		cache.Reset()
+	}
+	opts := []client.Option{
+		client.WithAddress(targetHost),
+		client.WithTLSConfig(&conf),
+		client.WithDirectory("."),
+		client.WithEventHandler(handleEvent),
+		client.WithHashCache(cache),
+		client.WithChannel(channel),
+		client.WithProfile(profile),
+	}
+	if manifestKey != nil {
+		opts = append(opts, client.WithPublicKey(manifestKey))
+	}
+	c, err := client.New(opts...)
 	if err != nil {
-		Crash("Error while loading UUID:", err.Error())
-	}
-	fmt.Println("Our UUID:", base64.StdEncoding.EncodeToString(uuid))
-	// Send it.
-	fmt.Println("Sending UUID...")
-	_, err = c.Write(uuid)
-	if err != nil {
-		Crash("Unable to send UUID", err.Error())
+		Crash("client.New", err)
 	}
 
-	connectionAccepted := false
-	err = binary.Read(c, binary.LittleEndian, &connectionAccepted)
-	if err != nil {
-		Crash("Unable to read connection status byte from stream:", err)
-	}
-	if connectionAccepted {
-		fmt.Print("Sending HW info... ")
-		err = WriteHWInfo(c)
-		if err != nil {
-			Crash("Unable to send HWInfo:", err.Error())
+	if restore {
+		if err := runRestore(c); err != nil {
+			Crash("Restore failed:", err)
 		}
-		fmt.Println("Sent!")
-	} else {
-		fmt.Println("Server rejected download request. " +
-			"Simply launching client for now.")
-		launchClient()
 		return
 	}
 
-	// Collect hashes of files in config/ and mods/ and send them.
-	fmt.Println("Hashing all files...")
-	// TODO: This thing can be merged together with code below to increase performance.
-	// E.g. pipeining, send file info right after hashing it.
-	if err := removeExcessFiles(c); err != nil {
-		Crash(err)
+	if rollback != 0 {
+		if err := runRollback(c); err != nil {
+			Crash("Rollback failed:", err)
+		}
+		launchClient()
+		return
 	}
 
-	zeroes := [32]byte{}
-	_, err = c.Write(zeroes[:])
+	uuid, err := client.LoadUUID(".")
 	if err != nil {
-		Crash("Failed to send hashlist terminator:", err)
+		Crash("Error while loading UUID:", err.Error())
 	}
+	fmt.Println("Our UUID:", base64.StdEncoding.EncodeToString(uuid[:]))
 
-	// Apply "changes" request by server - download new files.
-	fmt.Println("Listening for packets...")
-	for {
-		p, err := ReadPacket(c)
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("Connection closed.")
-				launchClient()
-				return
-			}
-			Crash("Error while receiving delta:", err.Error())
+	for attempt := 1; ; attempt++ {
+		err = runUpdate(c)
+		if err == nil {
+			break
 		}
-
-		if err := savePacket(p); err != nil {
-			Crash("savePacket", err)
+		if !isTransientError(err) || attempt == updateAttempts {
+			fmt.Println()
+			fmt.Println("Unable to update from the server.")
+			fmt.Println("If you really want to start Hexamine client without updating, " +
+				"run updater with --only-launch flag.")
+			Crash("Update failed:", err)
 		}
+		fmt.Println()
+		fmt.Println("Update interrupted:", err)
+		fmt.Println("Reconnecting in 5 seconds...")
+		time.Sleep(5 * time.Second)
 	}
+	launchClient()
 }
@@ -13,25 +13,15 @@
 package main
 
 import (
-	"github.com/BurntSushi/toml"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"os"
-)
-
-type indexPath struct {
-	Path string `toml:"path"`
-
-	// ClientPath determines where the file must be stored on a client side.
-	// If this string begins with !, resulting client path will be Path with stripped ClientPath prefix.
-	ClientPath string `toml:"client_path"`
 
-	// Sync defines whether file must be kept in sync with client.
-	// false means that file must be present on client but is NOT required to be in sync
-	Sync bool `toml:"mandatory"`
-
-	// Recursive determines whether specified path must be indexed recursively.
-	// This has no effect on files.
-	Recursive bool `toml:"recursive"`
-}
+	"github.com/BurntSushi/toml"
+	"github.com/Hexawolf/SSProto/server"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
 
 // Config is a structure with configurable data for ss-server application
 type Config struct {
@@ -44,24 +34,84 @@ type Config struct {
 	Certificate string `toml:"ssl_cert"`
 	Key         string `toml:"ssl_key"`
 
-	Index []indexPath `toml:"index"`
+	// DrainTimeout is how many seconds active transfers are given to finish
+	// on shutdown before their connections are closed. Defaults to
+	// defaultDrainTimeout if missing.
+	DrainTimeout int `toml:"drain_timeout"`
+
+	// Limits protect server from crowds of clients.
+	Limits server.Limits `toml:"limits"`
+
+	// Registry is a file where clients are recorded. Defaults to
+	// defaultRegistry if missing.
+	Registry string `toml:"registry"`
+	// Reserve decides whether clients are served again. Without it clients
+	// are served again only if files changed since last time.
+	Reserve ReservePolicy `toml:"reserve"`
+
+	// Profile configured at top level is served to clients which don't
+	// request any, unless DefaultProfile says otherwise.
+	Profile
+
+	// Profiles are additional sets of files clients can request by name.
+	Profiles map[string]Profile `toml:"profiles"`
+	// DefaultProfile is a name of profile served to clients which don't
+	// request any.
+	DefaultProfile string `toml:"default_profile"`
+	// ProfileOverrides maps base64-encoded client UUIDs to profiles they are
+	// always served from.
+	ProfileOverrides map[string]string `toml:"profile_overrides"`
+}
+
+// Profile describes a set of files served to clients.
+type Profile struct {
+	Index []server.IndexRule `toml:"index"`
+
+	// Managed lists directories where clients delete files which are not
+	// served. If it's missing, only "mods" is managed, as it always was.
+	Managed []ssproto.ManagedDir `toml:"managed"`
+
+	// Manifest is a path to signed release manifest created by ss-sign.
+	// Manifests are not served if it's empty.
+	Manifest string `toml:"manifest"`
+
+	// Releases is a directory where releases created with -release flag
+	// are stored. Channels are not served if it's empty.
+	Releases string `toml:"releases"`
+	// Channels maps channel names to release names.
+	Channels map[string]string `toml:"channels"`
+	// DefaultChannel is served to clients which don't request a channel.
+	// If it's empty, they get files from Index as they are now.
+	DefaultChannel string `toml:"default_channel"`
 
 	// A collection of snowflakes! ❄️
 	// Ignored contains files that must not be indexed and sent to client.
 	Ignored []string `toml:"ignored"`
 }
 
+const defaultDrainTimeout = 60
+
+const defaultRegistry = "clients.bin"
+
+var defaultManaged = []ssproto.ManagedDir{
+	{Path: "mods"},
+}
+
 // NewConfig initializes a Config instance with some default values
 func (c *Config) NewConfig() {
 	c.Address = "0.0.0.0:48879"
 	c.ServerName = "hexawolf.me"
 	c.Certificate = "cert.pem"
 	c.Key = "key.pem"
+	c.DrainTimeout = defaultDrainTimeout
+	c.Registry = defaultRegistry
+	c.Reserve.OnlyIfChanged = true
 	c.Ignored = []string{
 		"shadowfacts",
 		"FastAsyncWorldEdit",
 	}
-	c.Index = []indexPath{
+	c.Managed = defaultManaged
+	c.Index = []server.IndexRule{
 		{
 			Path:       "config",
 			ClientPath: "config",
@@ -100,6 +150,97 @@ func (c *Config) LoadConfig(file string) error {
 		}
 	}
 	defer configFile.Close()
-	_, err = toml.DecodeReader(configFile, c)
+	md, err := toml.DecodeReader(configFile, c)
+	if !md.IsDefined("drain_timeout") {
+		c.DrainTimeout = defaultDrainTimeout
+	}
+	if c.Registry == "" {
+		c.Registry = defaultRegistry
+	}
+	if !md.IsDefined("reserve") {
+		c.Reserve.OnlyIfChanged = true
+	}
+	if c.Managed == nil {
+		c.Managed = defaultManaged
+	}
+	for name, p := range c.Profiles {
+		if p.Managed == nil {
+			p.Managed = defaultManaged
+			c.Profiles[name] = p
+		}
+	}
 	return err
 }
+
+// Validate checks config for mistakes TOML decoding doesn't catch.
+func (c *Config) Validate() error {
+	if c.Address == "" {
+		return errors.New("server address is not set")
+	}
+	if c.DrainTimeout < 0 {
+		return errors.New("negative drain timeout")
+	}
+	l := c.Limits
+	if l.MaxSessions < 0 || l.MaxQueue < 0 || l.MaxPerIP < 0 || l.IPRate < 0 ||
+		l.Bandwidth < 0 || l.SessionBandwidth < 0 {
+		return errors.New("negative limits")
+	}
+	if c.Reserve.TTL < 0 {
+		return errors.New("negative re-serve TTL")
+	}
+	if err := c.Profile.validate(); err != nil {
+		return err
+	}
+	for name, p := range c.Profiles {
+		if err := ssproto.CheckName(name); err != nil {
+			return fmt.Errorf("invalid profile name %q: %v", name, err)
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profile %q: %v", name, err)
+		}
+	}
+	if c.DefaultProfile != "" {
+		if _, ok := c.Profiles[c.DefaultProfile]; !ok {
+			return fmt.Errorf("default profile %q is not configured", c.DefaultProfile)
+		}
+	}
+	_, err := c.overrides()
+	return err
+}
+
+func (p *Profile) validate() error {
+	for _, rule := range p.Index {
+		if rule.Path == "" {
+			return errors.New("index rule without path")
+		}
+	}
+	for _, m := range p.Managed {
+		if err := ssproto.CheckPath(m.Path); err != nil {
+			return fmt.Errorf("managed directory: %v", err)
+		}
+	}
+	if p.DefaultChannel != "" {
+		if _, ok := p.Channels[p.DefaultChannel]; !ok {
+			return fmt.Errorf("default channel %q is not configured", p.DefaultChannel)
+		}
+	}
+	return nil
+}
+
+// overrides decodes ProfileOverrides and checks that profiles exist.
+func (c *Config) overrides() (map[ssproto.UUID]string, error) {
+	res := make(map[ssproto.UUID]string, len(c.ProfileOverrides))
+	for encodedID, name := range c.ProfileOverrides {
+		raw, err := base64.StdEncoding.DecodeString(encodedID)
+		if err != nil || len(raw) != ssproto.UUIDSize {
+			return nil, fmt.Errorf("invalid client UUID %q in profile overrides", encodedID)
+		}
+		if _, ok := c.Profiles[name]; !ok {
+			return nil, fmt.Errorf("profile %q of client %s is not configured", name, encodedID)
+		}
+		var id ssproto.UUID
+		copy(id[:], raw)
+		res[id] = name
+	}
+	return res, nil
+}
@@ -13,82 +13,250 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/fsnotify/fsnotify"
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/server"
+	"github.com/Hexawolf/SSProto/ssproto"
 )
 
-// SSProtoVersion is a protocol version. Used to determine if clients need update.
-const SSProtoVersion uint8 = 2
+var serverConfig Config
 
-var tlsConfig tls.Config
+// configFile is read on start and on SIGHUP.
+const configFile = "ssserver.toml"
 
-var serverConfig Config
+// hashCacheFile stores hashes of indexed files between restarts.
+const hashCacheFile = "hashcache.bin"
+
+// loadManifest reads signed release manifest and warns about indexed files it
+// doesn't describe.
+func loadManifest(path string, index *server.FSIndex) (*ssproto.SignedManifest, error) {
+	signed, err := server.LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := signed.Decode()
+	if err != nil {
+		return nil, err
+	}
+	files, release := index.Files()
+	defer release()
+	for _, path := range server.CheckManifest(files, m) {
+		log.Println("File doesn't match release manifest, clients will refuse it:", path)
+	}
+	return signed, nil
+}
+
+// openReleases loads release store of a profile and points channels to
+// releases.
+func openReleases(p Profile) (*server.ReleaseStore, error) {
+	store, err := server.OpenReleaseStore(p.Releases)
+	if err != nil {
+		return nil, err
+	}
+	channels := make(map[string]string, len(p.Channels)+1)
+	for channel, release := range p.Channels {
+		channels[channel] = release
+	}
+	if p.DefaultChannel != "" {
+		release, ok := p.Channels[p.DefaultChannel]
+		if !ok {
+			return nil, fmt.Errorf("default channel %q is not configured", p.DefaultChannel)
+		}
+		channels[""] = release
+	}
+	if err := store.SetChannels(channels); err != nil {
+		return nil, err
+	}
+	for channel, release := range p.Channels {
+		log.Printf("Channel %q serves release %q", channel, release)
+	}
+	return store, nil
+}
+
+// createRelease makes a new release from indexed files of a profile. Manifest
+// is included only if it describes the files.
+func createRelease(name string, lp *loadedProfile) error {
+	store, err := server.OpenReleaseStore(lp.releases)
+	if err != nil {
+		return err
+	}
+	manifest := lp.Manifest
+	if manifest != nil {
+		m, err := manifest.Decode()
+		if err != nil {
+			return err
+		}
+		files, release := lp.index.Files()
+		mismatched := server.CheckManifest(files, m)
+		release()
+		if len(mismatched) != 0 {
+			log.Println("Release manifest doesn't match indexed files, release will have none")
+			manifest = nil
+		}
+	}
+	r, err := store.Create(name, lp.index, manifest)
+	if err != nil {
+		return err
+	}
+	files, _ := r.Files()
+	log.Printf("Created release %q with %d files", r.Name, len(files))
+	return nil
+}
 
 func main() {
+	rehash := flag.Bool("rehash", false, "ignore cached hashes and hash all files again")
+	releaseName := flag.String("release", "", "create release with given name from indexed files and exit")
+	releaseProfile := flag.String("profile", "", "profile to create release of with -release")
+	flag.Parse()
+
 	// Rotate logs and set up logging to both file and stdout
 	// See logging.go
 	LogInitialize()
-	log.Println("SSProto version", SSProtoVersion)
+	log.Println("SSProto version", ssproto.Version)
 	log.Println("Copyright (C) Hexawolf  2018")
 	var err error
 
 	// Loading server config
-	err = serverConfig.LoadConfig("ssserver.toml")
+	err = serverConfig.LoadConfig(configFile)
 	if err != nil {
 		log.Panicln("Failed to read server config:", err)
 	}
+	if err := serverConfig.Validate(); err != nil {
+		log.Panicln("Invalid server config:", err)
+	}
 
 	// Initialize TLS
-	var cert tls.Certificate
-	cert, err = tls.LoadX509KeyPair(serverConfig.Certificate, serverConfig.Key)
+	// Certificate is taken from holder, so it can be reloaded on SIGHUP.
+	keyPair, err := tls.LoadX509KeyPair(serverConfig.Certificate, serverConfig.Key)
 	if err != nil {
 		log.Panicln("Failed to initialize TLS:", err)
 	}
-	tlsConfig = tls.Config{
-		Certificates:       []tls.Certificate{cert},
+	cert := &certificate{cert: &keyPair}
+	tlsConfig := &tls.Config{
+		GetCertificate:     cert.get,
 		ServerName:         serverConfig.ServerName,
 		InsecureSkipVerify: true,
 	}
 
 	// Prepares served files list
-	// lister.go
-	watcher, err = fsnotify.NewWatcher()
+	// See server/fsindex.go
+	cache := hashcache.Open(hashCacheFile)
+	if *rehash {
+		cache.Reset()
+	}
+	base, err := loadProfile("", serverConfig.Profile, cache)
 	if err != nil {
-		log.Panicln("Failed to initialize fsnotify:", err)
+		log.Panicln("Failed to load served files:", err)
+	}
+	defer base.index.Close()
+	profiles := make(map[string]*loadedProfile, len(serverConfig.Profiles))
+	for name, p := range serverConfig.Profiles {
+		lp, err := loadProfile(name, p, cache)
+		if err != nil {
+			log.Panicf("Failed to load profile %q: %v", name, err)
+		}
+		defer lp.index.Close()
+		profiles[name] = lp
 	}
-	ListFiles()
-	go handleFSEvents()
 
 	defer logFile.Close()
 
-	laddr, err := net.ResolveTCPAddr("tcp", serverConfig.Address)
-	if err != nil {
-		log.Panicln("Error listening:", err)
+	if *releaseName != "" {
+		lp := base
+		if *releaseProfile != "" {
+			lp = profiles[*releaseProfile]
+			if lp == nil {
+				log.Panicf("Profile %q is not configured", *releaseProfile)
+			}
+		}
+		if lp.releases == "" {
+			log.Panicln("Releases directory is not configured")
+		}
+		if err := createRelease(*releaseName, lp); err != nil {
+			log.Panicln("Failed to create release:", err)
+		}
+		return
 	}
 
-	l, err := net.ListenTCP("tcp", laddr)
+	clients, err := openRegistry(serverConfig.Registry, serverConfig.Reserve)
 	if err != nil {
-		log.Panicln("Error listening:", err)
+		log.Panicln("Failed to load client registry:", err)
+	}
+	defer func() {
+		if err := clients.Close(); err != nil {
+			log.Println("Failed to save client registry:", err)
+		}
+	}()
+
+	opts := []server.Option{
+		server.WithAddress(serverConfig.Address),
+		server.WithTLSConfig(tlsConfig),
+		server.WithFileSource(base.Files),
+		server.WithManagedDirs(base.Managed),
+		server.WithLimits(serverConfig.Limits),
+		server.WithHooks(server.Hooks{
+			Accept: clients.accept,
+			Served: clients.served,
+		}),
+	}
+	if base.Manifest != nil {
+		opts = append(opts, server.WithManifest(base.Manifest))
+	}
+	if base.Channels != nil {
+		opts = append(opts, server.WithChannels(base.Channels))
+	}
+	if len(profiles) != 0 {
+		set, err := profileSet(profiles)
+		if err != nil {
+			log.Panicln("Failed to load profiles:", err)
+		}
+		opts = append(opts, server.WithProfiles(set))
 	}
-	// Close the listener when the application closes.
-	defer l.Close()
-	log.Println("Listening on", serverConfig.Address)
 
 	// Start network message processing service
-	service := NewService()
-	go service.Serve(l)
+	service, err := server.New(opts...)
+	if err != nil {
+		log.Panicln("Failed to initialize server:", err)
+	}
+	go func() {
+		if err := service.ListenAndServe(); err != server.ErrServerClosed {
+			log.Panicln("Error listening:", err)
+		}
+	}()
 
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
-	<-c
+	for sig := range c {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		log.Println("SIGHUP caught, reloading config...")
+		if err := reloadConfig(configFile, cert, base, profiles); err != nil {
+			log.Println("Config is not reloaded, keeping the old one:", err)
+			continue
+		}
+		log.Println("Config reloaded")
+	}
 	fmt.Println()
-	log.Println("Signal caught, waiting for connections to close and exiting...")
-	service.Stop()
+	drain := time.Duration(serverConfig.DrainTimeout) * time.Second
+	log.Println("Signal caught, waiting up to", drain, "for connections to close and exiting...")
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	go func() {
+		<-c
+		log.Println("Signal caught again, closing connections")
+		cancel()
+	}()
+	if err := service.Shutdown(ctx); err != nil {
+		log.Println("Connections were closed before transfers finished:", err)
+	}
 }
@@ -0,0 +1,84 @@
+// profile.go - loading served file sets
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/Hexawolf/SSProto/hashcache"
+	"github.com/Hexawolf/SSProto/server"
+)
+
+// loadedProfile is a Profile with indexed files and loaded manifest.
+type loadedProfile struct {
+	server.Profile
+	index *server.FSIndex
+	// releases is a directory of profile releases, empty if not configured.
+	releases string
+}
+
+// loadProfile indexes files of a profile, loads its manifest and releases.
+// name is only used in log messages, it's empty for top-level profile.
+func loadProfile(name string, p Profile, cache *hashcache.Cache) (*loadedProfile, error) {
+	index, err := server.NewFSIndex(p.Index, p.Ignored, nil, server.WithHashCache(cache))
+	if err != nil {
+		return nil, err
+	}
+	lp := &loadedProfile{
+		Profile: server.Profile{
+			Name:    name,
+			Files:   index,
+			Managed: p.Managed,
+		},
+		index:    index,
+		releases: p.Releases,
+	}
+	if p.Manifest != "" {
+		lp.Manifest, err = loadManifest(p.Manifest, index)
+		if err != nil {
+			index.Close()
+			return nil, fmt.Errorf("release manifest: %v", err)
+		}
+	}
+	if p.Releases != "" {
+		store, err := openReleases(p)
+		if err != nil {
+			index.Close()
+			return nil, fmt.Errorf("releases: %v", err)
+		}
+		lp.Channels = store
+	}
+	if name != "" {
+		log.Printf("Loaded profile %q", name)
+	}
+	return lp, nil
+}
+
+// profileSet collects named profiles into a server.ProfileSet. Config must be
+// validated already.
+func profileSet(profiles map[string]*loadedProfile) (*server.ProfileSet, error) {
+	overrides, err := serverConfig.overrides()
+	if err != nil {
+		return nil, err
+	}
+	set := &server.ProfileSet{
+		Profiles:  make(map[string]server.Profile, len(profiles)),
+		Default:   serverConfig.DefaultProfile,
+		Overrides: overrides,
+	}
+	for name, lp := range profiles {
+		set.Profiles[name] = lp.Profile
+	}
+	return set, nil
+}
@@ -0,0 +1,209 @@
+// registry.go - persistent record of clients and re-serve policy
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/gob"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Hexawolf/SSProto/server"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// registrySaveDelay is how long changes of registry are collected before
+// they are saved.
+const registrySaveDelay = 5 * time.Second
+
+// ReservePolicy decides whether a client which was served before is served
+// again. Without any restrictions clients are served every time.
+type ReservePolicy struct {
+	// TTL is how many seconds must pass since client was served last time
+	// before it's served again. 0 means it's not considered.
+	TTL int `toml:"ttl"`
+	// OnlyIfChanged makes clients served again when files they would get
+	// differ from those served last time.
+	OnlyIfChanged bool `toml:"only_if_changed"`
+}
+
+// clientRecord is what registry knows about a client.
+type clientRecord struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Zero if client was never served successfully.
+	LastServed time.Time
+
+	// Profile and release served last time and version of served files,
+	// see server.FilesVersion.
+	Profile string
+	Release string
+	Version ssproto.Hash
+
+	IP     string
+	HWInfo []byte
+}
+
+// registry records clients in a file, so it survives restarts.
+type registry struct {
+	path   string
+	policy ReservePolicy
+
+	mtx       sync.Mutex
+	clients   map[ssproto.UUID]*clientRecord
+	saveTimer *time.Timer
+}
+
+// openRegistry loads registry from file at path. Missing file results in an
+// empty registry, it will be created when the first client connects.
+func openRegistry(path string, policy ReservePolicy) (*registry, error) {
+	r := &registry{
+		path:    path,
+		policy:  policy,
+		clients: make(map[ssproto.UUID]*clientRecord),
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&r.clients); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// shouldServe applies re-serve policy to a client which is about to get files
+// of given version.
+func (r *registry) shouldServe(rec *clientRecord, version ssproto.Hash, now time.Time) bool {
+	if rec.LastServed.IsZero() {
+		return true
+	}
+	ttl := time.Duration(r.policy.TTL) * time.Second
+	if ttl == 0 && !r.policy.OnlyIfChanged {
+		return true
+	}
+	if r.policy.OnlyIfChanged && rec.Version != version {
+		return true
+	}
+	return ttl != 0 && now.Sub(rec.LastServed) >= ttl
+}
+
+// accept is a server.Hooks.Accept callback.
+func (r *registry) accept(info server.ClientInfo) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	now := time.Now()
+	rec, ok := r.clients[info.ID]
+	if !ok {
+		rec = &clientRecord{FirstSeen: now}
+		r.clients[info.ID] = rec
+	}
+	rec.LastSeen = now
+	rec.IP = ipOf(info)
+	r.scheduleSave()
+
+	if !r.shouldServe(rec, info.Version, now) {
+		log.Println("Already served", base64.StdEncoding.EncodeToString(info.ID[:]),
+			"at", rec.LastServed.Format(time.RFC3339), "from", info.Addr)
+		return false
+	}
+	return true
+}
+
+// served is a server.Hooks.Served callback.
+func (r *registry) served(info server.ClientInfo) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	rec, ok := r.clients[info.ID]
+	if !ok {
+		// accept saw it, unless registry was replaced meanwhile.
+		rec = &clientRecord{FirstSeen: time.Now(), LastSeen: time.Now()}
+		r.clients[info.ID] = rec
+	}
+	rec.LastServed = time.Now()
+	rec.Profile = info.Profile
+	rec.Release = info.Release
+	rec.Version = info.Version
+	rec.IP = ipOf(info)
+	rec.HWInfo = info.HWInfo
+	r.scheduleSave()
+}
+
+// ipOf returns IP address of a client without port.
+func ipOf(info server.ClientInfo) string {
+	if info.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(info.Addr.String())
+	if err != nil {
+		return info.Addr.String()
+	}
+	return host
+}
+
+// scheduleSave saves registry a few seconds later, so a crowd of clients
+// doesn't make it rewritten for each of them. mtx must be held.
+func (r *registry) scheduleSave() {
+	if r.saveTimer != nil {
+		return
+	}
+	r.saveTimer = time.AfterFunc(registrySaveDelay, func() {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		r.saveTimer = nil
+		if err := r.save(); err != nil {
+			log.Println("Failed to save client registry:", err)
+		}
+	})
+}
+
+// save writes registry to a temporary file and replaces the old one with it,
+// so a crash never leaves it half-written. mtx must be held.
+func (r *registry) save() error {
+	tmp := r.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(r.clients)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+// Close saves pending changes.
+func (r *registry) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.saveTimer == nil {
+		return nil
+	}
+	r.saveTimer.Stop()
+	r.saveTimer = nil
+	return r.save()
+}
@@ -0,0 +1,193 @@
+// reload.go - applying config changes without restart
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/Hexawolf/SSProto/server"
+)
+
+// certificate holds TLS certificate which can be replaced while server is
+// running. New connections use the latest one.
+type certificate struct {
+	mtx  sync.RWMutex
+	cert *tls.Certificate
+}
+
+// get is a tls.Config.GetCertificate callback.
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certificate) set(cert *tls.Certificate) {
+	c.mtx.Lock()
+	c.cert = cert
+	c.mtx.Unlock()
+}
+
+// profileLabel names a profile in log messages.
+func profileLabel(name string) string {
+	if name == "" {
+		return "Top-level profile"
+	}
+	return fmt.Sprintf("Profile %q", name)
+}
+
+// reloadConfig reads config file again and applies index rules, ignore lists,
+// TLS certificate and drain timeout from it. Other changes are logged but require restart.
+// Nothing is changed if new config is invalid.
+func reloadConfig(path string, cert *certificate, base *loadedProfile, profiles map[string]*loadedProfile) error {
+	// LoadConfig would create default config in place of missing one.
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	var c Config
+	if err := c.LoadConfig(path); err != nil {
+		return err
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	newCert, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
+	if err != nil {
+		return fmt.Errorf("TLS: %v", err)
+	}
+
+	logRestartRequired(&serverConfig, &c)
+	cert.set(&newCert)
+	if serverConfig.Certificate != c.Certificate || serverConfig.Key != c.Key {
+		log.Printf("TLS certificate changed from %s to %s", serverConfig.Certificate, c.Certificate)
+	} else {
+		log.Println("TLS certificate reloaded from", c.Certificate)
+	}
+	serverConfig.Certificate, serverConfig.Key = c.Certificate, c.Key
+	if serverConfig.DrainTimeout != c.DrainTimeout {
+		log.Printf("Drain timeout changed from %d to %d seconds", serverConfig.DrainTimeout, c.DrainTimeout)
+		serverConfig.DrainTimeout = c.DrainTimeout
+	}
+
+	applyRules("", &serverConfig.Profile, &c.Profile, base.index)
+	for name, lp := range profiles {
+		p, ok := c.Profiles[name]
+		if !ok {
+			continue
+		}
+		old := serverConfig.Profiles[name]
+		applyRules(name, &old, &p, lp.index)
+		serverConfig.Profiles[name] = old
+	}
+	return nil
+}
+
+// applyRules logs differences of index rules and ignore lists of a profile
+// and gives new ones to its index. old is updated to match.
+func applyRules(name string, old, new *Profile, index *server.FSIndex) {
+	added, removed := diffStrings(rulesStrings(old.Index), rulesStrings(new.Index))
+	for _, rule := range added {
+		log.Printf("%s: index rule added: %s", profileLabel(name), rule)
+	}
+	for _, rule := range removed {
+		log.Printf("%s: index rule removed: %s", profileLabel(name), rule)
+	}
+	changed := len(added) != 0 || len(removed) != 0
+
+	added, removed = diffStrings(old.Ignored, new.Ignored)
+	for _, s := range added {
+		log.Printf("%s: ignoring %q", profileLabel(name), s)
+	}
+	for _, s := range removed {
+		log.Printf("%s: not ignoring %q anymore", profileLabel(name), s)
+	}
+	if !changed && len(added) == 0 && len(removed) == 0 {
+		return
+	}
+	old.Index, old.Ignored = new.Index, new.Ignored
+	index.SetRules(new.Index, new.Ignored)
+}
+
+func rulesStrings(rules []server.IndexRule) []string {
+	res := make([]string, len(rules))
+	for i, rule := range rules {
+		res[i] = fmt.Sprintf("%+v", rule)
+	}
+	return res
+}
+
+// diffStrings returns strings present only in new and only in old.
+func diffStrings(old, new []string) (added, removed []string) {
+	oldSet := make(map[string]struct{}, len(old))
+	for _, s := range old {
+		oldSet[s] = struct{}{}
+	}
+	newSet := make(map[string]struct{}, len(new))
+	for _, s := range new {
+		newSet[s] = struct{}{}
+		if _, ok := oldSet[s]; !ok {
+			added = append(added, s)
+		}
+	}
+	for _, s := range old {
+		if _, ok := newSet[s]; !ok {
+			removed = append(removed, s)
+		}
+	}
+	return added, removed
+}
+
+// logRestartRequired warns about changed settings which are not applied
+// until restart.
+func logRestartRequired(old, new *Config) {
+	warn := func(setting string, old, new interface{}) {
+		if !reflect.DeepEqual(old, new) {
+			log.Printf("%s changed, restart the server to apply", setting)
+		}
+	}
+	warn("server_address", old.Address, new.Address)
+	warn("server_name", old.ServerName, new.ServerName)
+	warn("limits", old.Limits, new.Limits)
+	warn("registry", old.Registry, new.Registry)
+	warn("reserve", old.Reserve, new.Reserve)
+	warn("default_profile", old.DefaultProfile, new.DefaultProfile)
+	warn("profile_overrides", old.ProfileOverrides, new.ProfileOverrides)
+
+	profileWarn := func(name string, old, new *Profile) {
+		label := profileLabel(name)
+		warn(label+": managed", old.Managed, new.Managed)
+		warn(label+": manifest", old.Manifest, new.Manifest)
+		warn(label+": releases", old.Releases, new.Releases)
+		warn(label+": channels", old.Channels, new.Channels)
+		warn(label+": default_channel", old.DefaultChannel, new.DefaultChannel)
+	}
+	profileWarn("", &old.Profile, &new.Profile)
+	for name, p := range old.Profiles {
+		newP, ok := new.Profiles[name]
+		if !ok {
+			log.Printf("%s removed, restart the server to apply", profileLabel(name))
+			continue
+		}
+		profileWarn(name, &p, &newP)
+	}
+	for name := range new.Profiles {
+		if _, ok := old.Profiles[name]; !ok {
+			log.Printf("%s added, restart the server to apply", profileLabel(name))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// main.go - offline signing of release manifests
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Hexawolf/SSProto/server"
+	"github.com/Hexawolf/SSProto/ssproto"
+)
+
+// Config contains fields of ss-server config needed to index release files.
+type Config struct {
+	Profile
+	Profiles map[string]Profile `toml:"profiles"`
+}
+
+// Profile contains fields of a single ss-server profile needed to index its
+// files. Top-level files are described the same way.
+type Profile struct {
+	Index   []server.IndexRule `toml:"index"`
+	Ignored []string           `toml:"ignored"`
+}
+
+// genKey creates a new key pair. Private key is written to keyPath, public
+// one to keyPath + ".pub", both base64-encoded.
+func genKey(keyPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(priv)), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath+".pub", []byte(base64.StdEncoding.EncodeToString(pub)), 0644)
+}
+
+func loadKey(keyPath string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", keyPath)
+	}
+	return key, nil
+}
+
+// sign indexes files of profile (top-level ones if it's empty) described by
+// config and writes signed manifest to out.
+func sign(keyPath, configPath, profile, out string) error {
+	key, err := loadKey(keyPath)
+	if err != nil {
+		return err
+	}
+	var config Config
+	if _, err := toml.DecodeFile(configPath, &config); err != nil {
+		return err
+	}
+	p := config.Profile
+	if profile != "" {
+		var ok bool
+		if p, ok = config.Profiles[profile]; !ok {
+			return fmt.Errorf("profile %q is not configured in %s", profile, configPath)
+		}
+	}
+
+	index, err := server.NewFSIndex(p.Index, p.Ignored, nil)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	files, release := index.Files()
+	m := server.NewManifest(files)
+	release()
+
+	signed, err := ssproto.SignManifest(m, key)
+	if err != nil {
+		return err
+	}
+	if err := server.SaveManifest(out, signed); err != nil {
+		return err
+	}
+	log.Println("Signed", len(m.Entries), "files to", out)
+	return nil
+}
+
+func main() {
+	genkey := flag.Bool("genkey", false, "generate a new key pair instead of signing")
+	keyPath := flag.String("key", "release.key", "private key `file`, public key is stored next to it with .pub suffix")
+	configPath := flag.String("config", "ssserver.toml", "ss-server config `file` listing release files")
+	profile := flag.String("profile", "", "sign files of named profile instead of top-level ones")
+	out := flag.String("out", "release.manifest", "signed manifest output `file`")
+	flag.Parse()
+
+	var err error
+	if *genkey {
+		err = genKey(*keyPath)
+	} else {
+		err = sign(*keyPath, *configPath, *profile, *out)
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+// caps.go - optional protocol features negotiated during handshake
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Capabilities is a set of optional protocol features. Since version 3 both
+// sides exchange sets of features they support and use only those present
+// in both (see Intersect).
+type Capabilities uint64
+
+// Known capabilities. Bits not listed here must be ignored.
+const (
+	// CapCompression allows compressed file blobs.
+	CapCompression Capabilities = 1 << iota
+	// CapDelta allows block-level delta transfer of changed files.
+	CapDelta
+	// CapResume allows resuming interrupted file transfers.
+	CapResume
+	// CapMetadata allows additional metadata (like content hash) in file blobs.
+	CapMetadata
+	// CapManifest makes server send a signed release manifest.
+	CapManifest
+	// CapBatchVerdicts makes server reply to the whole hash-list at once
+	// instead of replying to each entry.
+	CapBatchVerdicts
+	// CapManagedDirs makes server tell which directories it manages, see
+	// ManagedDir.
+	CapManagedDirs
+	// CapChannels lets client request a release channel, see
+	// WriteChannelRequest.
+	CapChannels
+	// CapProfiles lets client request a profile, that is, one of several
+	// sets of files served by the same server. See WriteProfileRequest.
+	CapProfiles
+	// CapQueue makes server report client position while it waits for a
+	// free session slot, see WriteQueuePosition.
+	CapQueue
+)
+
+var capNames = []string{
+	"compression",
+	"delta",
+	"resume",
+	"metadata",
+	"manifest",
+	"batch-verdicts",
+	"managed-dirs",
+	"channels",
+	"profiles",
+	"queue",
+}
+
+// Has reports whether all capabilities from other are present in c.
+func (c Capabilities) Has(other Capabilities) bool {
+	return c&other == other
+}
+
+// HasFileHash reports whether file blobs carry a hash of resulting file
+// contents. The hash is needed both to verify received files (CapMetadata)
+// and to refer to them in resume requests (CapResume).
+func (c Capabilities) HasFileHash() bool {
+	return c&(CapResume|CapMetadata) != 0
+}
+
+// Intersect returns capabilities present in both sets.
+func (c Capabilities) Intersect(other Capabilities) Capabilities {
+	return c & other
+}
+
+// String returns comma-separated list of capability names. Unknown bits are
+// printed as their numbers.
+func (c Capabilities) String() string {
+	var names []string
+	for bit := uint(0); bit < 64; bit++ {
+		if c&(1<<bit) == 0 {
+			continue
+		}
+		if int(bit) < len(capNames) {
+			names = append(names, capNames[bit])
+		} else {
+			names = append(names, "bit"+strconv.Itoa(int(bit)))
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
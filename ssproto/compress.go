@@ -0,0 +1,115 @@
+// compress.go - compression of file blobs
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// CompressionSampleSize is the amount of data ShouldCompress looks at.
+const CompressionSampleSize = 64 * 1024
+
+// ShouldCompress tells whether compressing data starting with sample is
+// worth it. Already compressed formats (jars, images, archives) barely
+// shrink and only waste CPU on both sides.
+func ShouldCompress(sample []byte) bool {
+	if len(sample) > CompressionSampleSize {
+		sample = sample[:CompressionSampleSize]
+	}
+	// Tiny files don't benefit from compression.
+	if len(sample) < 512 {
+		return false
+	}
+	var cw countingWriter
+	zw, _ := flate.NewWriter(&cw, flate.BestSpeed)
+	zw.Write(sample)
+	zw.Close()
+	// Require at least 10% savings.
+	return cw.n < len(sample)*9/10
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.n += len(b)
+	return len(b), nil
+}
+
+// ErrCompressedTooLong is returned when compressed file contents decompress
+// into more than file size bytes.
+var ErrCompressedTooLong = errors.New("ssproto: compressed contents exceed file size")
+
+// inflater yields exactly size bytes of decompressed data and consumes the
+// end of compressed stream afterwards, so next message can be read.
+type inflater struct {
+	zr        io.ReadCloser
+	remaining uint64
+	done      bool
+	// err is returned by all reads once the stream turned out to be bad.
+	err error
+}
+
+func newInflater(r io.Reader, size uint64) *inflater {
+	return &inflater{zr: flate.NewReader(r), remaining: size}
+}
+
+func (i *inflater) Read(b []byte) (int, error) {
+	var n int
+	var err error
+	if i.remaining > 0 {
+		if uint64(len(b)) > i.remaining {
+			b = b[:i.remaining]
+		}
+		n, err = i.zr.Read(b)
+		i.remaining -= uint64(n)
+		if i.remaining > 0 {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+	}
+	if !i.done {
+		i.done = true
+		i.err = i.finish()
+	}
+	if i.err != nil {
+		return n, i.err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, io.EOF
+}
+
+// finish reads the final block so it doesn't stay in the stream. The block
+// must not carry any data.
+func (i *inflater) finish() error {
+	var extra [1]byte
+	for {
+		n, err := i.zr.Read(extra[:])
+		if n > 0 {
+			return ErrCompressedTooLong
+		}
+		if err == io.EOF {
+			return i.zr.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
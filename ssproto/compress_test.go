@@ -0,0 +1,89 @@
+// compress_test.go - compressed file blob tests
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+package ssproto
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// deflated returns raw DEFLATE stream of data followed by next, which stands
+// for the next message in the stream.
+func deflated(t *testing.T, data, next string) []byte {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(next)
+	return buf.Bytes()
+}
+
+func TestInflaterRoundTrip(t *testing.T) {
+	data := strings.Repeat("abc", 10000)
+	r := bytes.NewReader(deflated(t, data, "next"))
+	got, err := ioutil.ReadAll(newInflater(r, uint64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+	// The whole compressed stream is consumed, but nothing after it.
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "next" {
+		t.Errorf("left %q in the stream, want %q", rest, "next")
+	}
+}
+
+func TestInflaterTooLong(t *testing.T) {
+	data := strings.Repeat("abc", 10000)
+	r := bytes.NewReader(deflated(t, data, ""))
+	_, err := ioutil.ReadAll(newInflater(r, uint64(len(data)-1)))
+	if err != ErrCompressedTooLong {
+		t.Errorf("got %v, want ErrCompressedTooLong", err)
+	}
+}
+
+func TestInflaterShort(t *testing.T) {
+	data := strings.Repeat("abc", 10000)
+	r := bytes.NewReader(deflated(t, data, ""))
+	_, err := ioutil.ReadAll(newInflater(r, uint64(len(data)+1)))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	if !ShouldCompress([]byte(strings.Repeat("text ", 1000))) {
+		t.Error("text is not compressed")
+	}
+	random := make([]byte, 4096)
+	rand.Read(random)
+	if ShouldCompress(random) {
+		t.Error("random data is compressed")
+	}
+	if ShouldCompress([]byte("tiny")) {
+		t.Error("tiny file is compressed")
+	}
+}
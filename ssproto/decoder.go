@@ -0,0 +1,205 @@
+// decoder.go - deserialization of SSProto messages
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Decoder reads SSProto messages from an input stream.
+type Decoder struct {
+	r       io.Reader
+	version uint8
+	caps    Capabilities
+}
+
+// NewDecoder returns a new decoder that reads from r. Messages are decoded
+// according to VersionLegacy until SetVersion is called.
+//
+// Decoder buffers input, so r must not be read directly once decoder was
+// created.
+func NewDecoder(r io.Reader) *Decoder {
+	// Decompressor needs io.ByteReader to not read past the end of
+	// compressed stream.
+	return &Decoder{r: bufio.NewReader(r), version: VersionLegacy}
+}
+
+// SetVersion selects protocol version negotiated during handshake.
+func (d *Decoder) SetVersion(v uint8) {
+	d.version = v
+}
+
+// SetCapabilities selects capabilities negotiated during handshake. Some of
+// them change layout of messages.
+func (d *Decoder) SetCapabilities(c Capabilities) {
+	d.caps = c
+}
+
+// ReadVersion receives protocol version.
+func (d *Decoder) ReadVersion() (uint8, error) {
+	var v uint8
+	err := binary.Read(d.r, binary.LittleEndian, &v)
+	return v, err
+}
+
+// ReadCapabilities receives a set of capabilities.
+func (d *Decoder) ReadCapabilities() (Capabilities, error) {
+	var c uint64
+	err := binary.Read(d.r, binary.LittleEndian, &c)
+	return Capabilities(c), err
+}
+
+// ReadUUID receives client identifier.
+func (d *Decoder) ReadUUID() (UUID, error) {
+	var id UUID
+	_, err := io.ReadFull(d.r, id[:])
+	return id, err
+}
+
+// ReadBool receives 8-bit unsigned integer and interprets it as boolean.
+func (d *Decoder) ReadBool() (bool, error) {
+	var v bool
+	err := binary.Read(d.r, binary.LittleEndian, &v)
+	return v, err
+}
+
+// ReadVerdict receives a reply to hash-list entry.
+func (d *Decoder) ReadVerdict() (Verdict, error) {
+	var v Verdict
+	err := binary.Read(d.r, binary.LittleEndian, &v)
+	return v, err
+}
+
+// ReadVerdicts receives replies to all hash-list entries sent with
+// WriteVerdicts.
+func (d *Decoder) ReadVerdicts() ([]Verdict, error) {
+	size, err := d.readLength(MaxVerdicts)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(d.r, b)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Verdict, size)
+	for i := range b {
+		res[i] = Verdict(b[i])
+	}
+	return res, nil
+}
+
+// readLength receives length prefix of dynamic-length data and checks it
+// against limit.
+func (d *Decoder) readLength(limit uint64) (uint64, error) {
+	var size uint64
+	err := binary.Read(d.r, binary.LittleEndian, &size)
+	if err != nil {
+		return 0, err
+	}
+	if size > limit {
+		return 0, ErrTooLong
+	}
+	return size, nil
+}
+
+// ReadBlob receives dynamic-length data. Blobs longer than MaxBlobLength are
+// rejected with ErrTooLong.
+func (d *Decoder) ReadBlob() ([]byte, error) {
+	size, err := d.readLength(MaxBlobLength)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(d.r, b)
+	return b, err
+}
+
+// readPath receives dynamic-length path.
+func (d *Decoder) readPath() (string, error) {
+	size, err := d.readLength(MaxPathLength)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(d.r, b)
+	return string(b), err
+}
+
+// ReadHashListEntry receives a single hash-list entry. end is true if
+// terminator was received instead, entry is not valid in this case.
+func (d *Decoder) ReadHashListEntry() (entry HashListEntry, end bool, err error) {
+	_, err = io.ReadFull(d.r, entry.Hash[:])
+	if err != nil {
+		return entry, false, err
+	}
+	if entry.Hash.IsZero() {
+		return entry, true, nil
+	}
+	entry.Path, err = d.readPath()
+	return entry, false, err
+}
+
+// ReadFile receives file blob header. Returned File.Body is bound to the
+// underlying stream and must be fully consumed before next read. Unsafe
+// paths (see CheckPath) are rejected with ErrUnsafePath. Since version 3 end
+// is true if the list of files is over, res is nil in this case. Version 2
+// peers just close the connection instead.
+func (d *Decoder) ReadFile() (res *File, end bool, err error) {
+	res = new(File)
+	res.Path, err = d.readPath()
+	if err != nil {
+		return nil, false, err
+	}
+	if d.version >= 3 && res.Path == "" {
+		return nil, true, nil
+	}
+	if err := CheckPath(res.Path); err != nil {
+		return nil, false, err
+	}
+	if d.version >= 3 {
+		err = binary.Read(d.r, binary.LittleEndian, &res.Flags)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err = binary.Read(d.r, binary.LittleEndian, &res.Size)
+	if err != nil {
+		return nil, false, err
+	}
+	if d.caps.HasFileHash() {
+		_, err = io.ReadFull(d.r, res.Hash[:])
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if res.Flags&FlagResumed != 0 {
+		err = binary.Read(d.r, binary.LittleEndian, &res.Offset)
+		if err != nil {
+			return nil, false, err
+		}
+		if res.Offset > res.Size {
+			return nil, false, ErrBadOffset
+		}
+	}
+	switch {
+	case res.Flags&FlagDelta != 0:
+	case res.Flags&FlagCompressed != 0:
+		res.Body = newInflater(d.r, res.Size-res.Offset)
+	default:
+		res.Body = io.LimitReader(d.r, int64(res.Size-res.Offset))
+	}
+	return res, false, nil
+}
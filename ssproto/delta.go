@@ -0,0 +1,165 @@
+// delta.go - messages used for block-level delta transfer
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// StrongSize is a size of strong block checksum (truncated BLAKE2b-256).
+const StrongSize = 16
+
+// MaxSignatureBlocks limits number of blocks in a received signature.
+const MaxSignatureBlocks = 1 << 22
+
+// signatureChunk is a number of blocks read at once by ReadSignature.
+const signatureChunk = 4096
+
+// BlockSignature contains checksums of a single block of a file.
+type BlockSignature struct {
+	// Weak is a rolling checksum of the block, see package delta.
+	Weak uint32
+	// Strong is a prefix of BLAKE2b-256 hash of the block.
+	Strong [StrongSize]byte
+}
+
+// Signature describes contents of a file client already has, so server can
+// send only blocks that differ.
+type Signature struct {
+	// Path in wire format (see ToWire).
+	Path      string
+	BlockSize uint32
+	Blocks    []BlockSignature
+}
+
+// Delta operation codes.
+const (
+	// DeltaEnd finishes delta-encoded file blob.
+	DeltaEnd uint8 = iota
+	// DeltaCopy makes client copy a block from its old version of the file.
+	DeltaCopy
+	// DeltaData carries literal data.
+	DeltaData
+)
+
+// DeltaOp is a single instruction for reconstructing a file.
+type DeltaOp struct {
+	Code uint8
+	// Index of block to copy for DeltaCopy.
+	Index uint64
+	// Literal data for DeltaData.
+	Data []byte
+}
+
+// ErrBadDeltaOp is returned when peer sent unknown delta operation code.
+var ErrBadDeltaOp = errors.New("ssproto: unknown delta operation")
+
+// WriteSignature sends a signature of a single file.
+func (e *Encoder) WriteSignature(sig Signature) error {
+	err := e.WriteString(ToWire(sig.Path))
+	if err != nil {
+		return err
+	}
+	err = binary.Write(e.w, binary.LittleEndian, sig.BlockSize)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(e.w, binary.LittleEndian, uint64(len(sig.Blocks)))
+	if err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, sig.Blocks)
+}
+
+// WriteSignaturesEnd sends an empty path which ends the list of signatures.
+func (e *Encoder) WriteSignaturesEnd() error {
+	return e.WriteString("")
+}
+
+// ReadSignature receives a signature of a single file. end is true if the
+// list of signatures is over, sig is nil in this case. Blocks are read in
+// chunks, so memory is spent only on data peer actually sent.
+func (d *Decoder) ReadSignature() (sig *Signature, end bool, err error) {
+	path, err := d.readPath()
+	if err != nil {
+		return nil, false, err
+	}
+	if path == "" {
+		return nil, true, nil
+	}
+	sig = &Signature{Path: path}
+	err = binary.Read(d.r, binary.LittleEndian, &sig.BlockSize)
+	if err != nil {
+		return nil, false, err
+	}
+	var count uint64
+	err = binary.Read(d.r, binary.LittleEndian, &count)
+	if err != nil {
+		return nil, false, err
+	}
+	if count > MaxSignatureBlocks {
+		return nil, false, ErrTooLong
+	}
+	for left := count; left > 0; {
+		n := left
+		if n > signatureChunk {
+			n = signatureChunk
+		}
+		chunk := make([]BlockSignature, n)
+		err = binary.Read(d.r, binary.LittleEndian, chunk)
+		if err != nil {
+			return nil, false, err
+		}
+		sig.Blocks = append(sig.Blocks, chunk...)
+		left -= n
+	}
+	return sig, false, nil
+}
+
+// WriteDeltaOp sends a single delta operation.
+func (e *Encoder) WriteDeltaOp(op DeltaOp) error {
+	err := binary.Write(e.w, binary.LittleEndian, op.Code)
+	if err != nil {
+		return err
+	}
+	switch op.Code {
+	case DeltaCopy:
+		return binary.Write(e.w, binary.LittleEndian, op.Index)
+	case DeltaData:
+		return e.WriteBlob(op.Data)
+	}
+	return nil
+}
+
+// ReadDeltaOp receives a single delta operation.
+func (d *Decoder) ReadDeltaOp() (op DeltaOp, err error) {
+	err = binary.Read(d.r, binary.LittleEndian, &op.Code)
+	if err != nil {
+		return op, err
+	}
+	switch op.Code {
+	case DeltaEnd:
+	case DeltaCopy:
+		err = binary.Read(d.r, binary.LittleEndian, &op.Index)
+	case DeltaData:
+		op.Data, err = d.ReadBlob()
+	default:
+		err = ErrBadDeltaOp
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return op, err
+}
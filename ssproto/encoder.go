@@ -0,0 +1,174 @@
+// encoder.go - serialization of SSProto messages
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"compress/flate"
+	"encoding/binary"
+	"io"
+)
+
+// Encoder writes SSProto messages to an output stream.
+type Encoder struct {
+	w       io.Writer
+	version uint8
+	caps    Capabilities
+}
+
+// NewEncoder returns a new encoder that writes to w. Messages are encoded
+// according to VersionLegacy until SetVersion is called.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, version: VersionLegacy}
+}
+
+// SetVersion selects protocol version negotiated during handshake.
+func (e *Encoder) SetVersion(v uint8) {
+	e.version = v
+}
+
+// SetCapabilities selects capabilities negotiated during handshake. Some of
+// them change layout of messages.
+func (e *Encoder) SetCapabilities(c Capabilities) {
+	e.caps = c
+}
+
+// WriteVersion sends protocol version.
+func (e *Encoder) WriteVersion(v uint8) error {
+	return binary.Write(e.w, binary.LittleEndian, v)
+}
+
+// WriteCapabilities sends a set of capabilities.
+func (e *Encoder) WriteCapabilities(c Capabilities) error {
+	return binary.Write(e.w, binary.LittleEndian, uint64(c))
+}
+
+// WriteUUID sends client identifier.
+func (e *Encoder) WriteUUID(id UUID) error {
+	_, err := e.w.Write(id[:])
+	return err
+}
+
+// WriteBool sends 1 or 0 as 8-bit unsigned integer. Used for connection
+// acceptance status and hash-list replies.
+func (e *Encoder) WriteBool(v bool) error {
+	return binary.Write(e.w, binary.LittleEndian, v)
+}
+
+// WriteVerdict sends a reply to hash-list entry.
+func (e *Encoder) WriteVerdict(v Verdict) error {
+	return binary.Write(e.w, binary.LittleEndian, v)
+}
+
+// WriteVerdicts sends replies to all hash-list entries at once, in order of
+// entries.
+func (e *Encoder) WriteVerdicts(v []Verdict) error {
+	b := make([]byte, len(v))
+	for i := range v {
+		b[i] = byte(v[i])
+	}
+	return e.WriteBlob(b)
+}
+
+// WriteBlob sends dynamic-length data prefixed with its length.
+func (e *Encoder) WriteBlob(b []byte) error {
+	err := binary.Write(e.w, binary.LittleEndian, uint64(len(b)))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b)
+	return err
+}
+
+// WriteString sends string as dynamic-length data.
+func (e *Encoder) WriteString(s string) error {
+	return e.WriteBlob([]byte(s))
+}
+
+// WriteHashListEntry sends a single hash-list entry.
+func (e *Encoder) WriteHashListEntry(entry HashListEntry) error {
+	_, err := e.w.Write(entry.Hash[:])
+	if err != nil {
+		return err
+	}
+	return e.WriteString(ToWire(entry.Path))
+}
+
+// WriteTerminator sends 32 zero bytes which end the hash-list.
+func (e *Encoder) WriteTerminator() error {
+	var zero Hash
+	_, err := e.w.Write(zero[:])
+	return err
+}
+
+// WriteFileHeader sends file blob header only. Caller is responsible for
+// sending file contents.
+func (e *Encoder) WriteFileHeader(f File) error {
+	err := e.WriteString(ToWire(f.Path))
+	if err != nil {
+		return err
+	}
+	if e.version >= 3 {
+		err = binary.Write(e.w, binary.LittleEndian, f.Flags)
+		if err != nil {
+			return err
+		}
+	}
+	err = binary.Write(e.w, binary.LittleEndian, f.Size)
+	if err != nil {
+		return err
+	}
+	if e.caps.HasFileHash() {
+		_, err = e.w.Write(f.Hash[:])
+		if err != nil {
+			return err
+		}
+	}
+	if f.Flags&FlagResumed != 0 {
+		err = binary.Write(e.w, binary.LittleEndian, f.Offset)
+	}
+	return err
+}
+
+// WriteFile sends file blob header followed by exactly f.Size-f.Offset bytes
+// read from f.Body. Contents are compressed if f.Flags has FlagCompressed.
+func (e *Encoder) WriteFile(f File) error {
+	err := e.WriteFileHeader(f)
+	if err != nil {
+		return err
+	}
+	if f.Flags&FlagCompressed == 0 {
+		_, err = io.CopyN(e.w, f.Body, int64(f.Size-f.Offset))
+		return err
+	}
+
+	zw, err := flate.NewWriter(e.w, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(zw, f.Body, int64(f.Size-f.Offset))
+	if err != nil {
+		return err
+	}
+	// Close only flushes the final block, e.w stays open.
+	return zw.Close()
+}
+
+// WriteFilesEnd sends an empty path which ends the list of files. It's sent
+// only since version 3, version 2 peers expect connection to be closed
+// instead.
+func (e *Encoder) WriteFilesEnd() error {
+	if e.version < 3 {
+		return nil
+	}
+	return e.WriteString("")
+}
@@ -0,0 +1,69 @@
+// managed.go - directories whose contents are controlled by server
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"encoding/binary"
+	"path"
+	"strings"
+)
+
+// ManagedDir is a directory on client side where server decides which files
+// may exist. Files server doesn't know about are deleted from it.
+type ManagedDir struct {
+	// Path in wire format (see ToWire).
+	Path string `toml:"path"`
+	// Recursive makes subdirectories managed too.
+	Recursive bool `toml:"recursive"`
+}
+
+// Manages reports whether file at p (in wire format) is inside of the
+// directory.
+func (m ManagedDir) Manages(p string) bool {
+	if path.Dir(p) == m.Path {
+		return true
+	}
+	return m.Recursive && strings.HasPrefix(p, m.Path+"/")
+}
+
+// WriteManagedDir sends a single managed directory.
+func (e *Encoder) WriteManagedDir(m ManagedDir) error {
+	err := e.WriteString(ToWire(m.Path))
+	if err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, m.Recursive)
+}
+
+// WriteManagedDirsEnd sends an empty path which ends the list of managed
+// directories.
+func (e *Encoder) WriteManagedDirsEnd() error {
+	return e.WriteString("")
+}
+
+// ReadManagedDir receives a single managed directory. end is true if the
+// list is over. Unsafe paths (see CheckPath) are rejected with ErrUnsafePath.
+func (d *Decoder) ReadManagedDir() (m ManagedDir, end bool, err error) {
+	m.Path, err = d.readPath()
+	if err != nil {
+		return m, false, err
+	}
+	if m.Path == "" {
+		return m, true, nil
+	}
+	if err := CheckPath(m.Path); err != nil {
+		return m, false, err
+	}
+	err = binary.Read(d.r, binary.LittleEndian, &m.Recursive)
+	return m, false, err
+}
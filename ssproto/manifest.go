@@ -0,0 +1,181 @@
+// manifest.go - signed lists of release files
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// MaxManifestLength limits size of a received manifest.
+const MaxManifestLength = 64 << 20
+
+// ErrBadSignature is returned when manifest signature doesn't match the key.
+var ErrBadSignature = errors.New("ssproto: bad manifest signature")
+
+// ManifestEntry describes a single file of a release.
+type ManifestEntry struct {
+	// Path in wire format (see ToWire).
+	Path string
+	Hash Hash
+	Size uint64
+	// Mode contains Unix permission bits of the file.
+	Mode uint32
+}
+
+// Manifest lists all files of a release. It is signed with a key kept away
+// from the server, so clients can tell files prepared by the release
+// maintainer from anything else server may send.
+type Manifest struct {
+	// Timestamp is a Unix time the manifest was created at. Clients refuse
+	// manifests older than one they already accepted.
+	Timestamp int64
+	Entries   []ManifestEntry
+}
+
+// Lookup returns entry with given path in wire format.
+func (m *Manifest) Lookup(path string) (ManifestEntry, bool) {
+	i := sort.Search(len(m.Entries), func(i int) bool {
+		return m.Entries[i].Path >= path
+	})
+	if i < len(m.Entries) && m.Entries[i].Path == path {
+		return m.Entries[i], true
+	}
+	return ManifestEntry{}, false
+}
+
+// MarshalBinary encodes manifest. Entries are sorted by path first, so equal
+// manifests always have equal encodings.
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	sort.Slice(m.Entries, func(i, j int) bool {
+		return m.Entries[i].Path < m.Entries[j].Path
+	})
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	binary.Write(&buf, binary.LittleEndian, m.Timestamp)
+	binary.Write(&buf, binary.LittleEndian, uint64(len(m.Entries)))
+	for _, entry := range m.Entries {
+		e.WriteString(entry.Path)
+		buf.Write(entry.Hash[:])
+		binary.Write(&buf, binary.LittleEndian, entry.Size)
+		binary.Write(&buf, binary.LittleEndian, entry.Mode)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes manifest encoded with MarshalBinary.
+func (m *Manifest) UnmarshalBinary(b []byte) error {
+	d := NewDecoder(bytes.NewReader(b))
+	err := binary.Read(d.r, binary.LittleEndian, &m.Timestamp)
+	if err != nil {
+		return err
+	}
+	count, err := d.readLength(uint64(len(b)))
+	if err != nil {
+		return err
+	}
+	m.Entries = make([]ManifestEntry, count)
+	for i := range m.Entries {
+		entry := &m.Entries[i]
+		entry.Path, err = d.readPath()
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(d.r, entry.Hash[:])
+		if err != nil {
+			return err
+		}
+		err = binary.Read(d.r, binary.LittleEndian, &entry.Size)
+		if err != nil {
+			return err
+		}
+		err = binary.Read(d.r, binary.LittleEndian, &entry.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	if !sort.SliceIsSorted(m.Entries, func(i, j int) bool {
+		return m.Entries[i].Path < m.Entries[j].Path
+	}) {
+		return errors.New("ssproto: manifest entries are not sorted")
+	}
+	return nil
+}
+
+// SignedManifest is an encoded Manifest along with its ed25519 signature.
+type SignedManifest struct {
+	Data      []byte
+	Signature [ed25519.SignatureSize]byte
+}
+
+// SignManifest encodes m and signs it with key.
+func SignManifest(m *Manifest, key ed25519.PrivateKey) (*SignedManifest, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	res := &SignedManifest{Data: data}
+	copy(res.Signature[:], ed25519.Sign(key, data))
+	return res, nil
+}
+
+// Verify checks manifest signature with key and decodes it.
+func (s *SignedManifest) Verify(key ed25519.PublicKey) (*Manifest, error) {
+	if !ed25519.Verify(key, s.Data, s.Signature[:]) {
+		return nil, ErrBadSignature
+	}
+	return s.Decode()
+}
+
+// Decode decodes manifest without checking the signature.
+func (s *SignedManifest) Decode() (*Manifest, error) {
+	m := new(Manifest)
+	if err := m.UnmarshalBinary(s.Data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteManifest sends signed manifest. The same format is used to store
+// manifests in files.
+func (e *Encoder) WriteManifest(s *SignedManifest) error {
+	err := e.WriteBlob(s.Data)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(s.Signature[:])
+	return err
+}
+
+// ReadManifest receives signed manifest. Signature is not checked.
+func (d *Decoder) ReadManifest() (*SignedManifest, error) {
+	size, err := d.readLength(MaxManifestLength)
+	if err != nil {
+		return nil, err
+	}
+	res := &SignedManifest{Data: make([]byte, size)}
+	_, err = io.ReadFull(d.r, res.Data)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(d.r, res.Signature[:])
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
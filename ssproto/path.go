@@ -0,0 +1,80 @@
+// path.go - validation of paths received from peer
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ErrUnsafePath is returned for paths in wire format which could point
+// outside of installation directory or be interpreted differently by
+// different operating systems.
+type ErrUnsafePath struct {
+	Path   string
+	Reason string
+}
+
+func (e ErrUnsafePath) Error() string {
+	return fmt.Sprintf("ssproto: unsafe path %q: %s", e.Path, e.Reason)
+}
+
+// Device names reserved by Windows regardless of extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// CheckPath makes sure that path in wire format is relative, stays inside of
+// the directory it's relative to and is a valid file name on every supported
+// OS. Symlinks are not checked, this is up to the caller.
+func CheckPath(path string) error {
+	unsafe := func(reason string) error {
+		return ErrUnsafePath{Path: path, Reason: reason}
+	}
+	if path == "" {
+		return unsafe("empty path")
+	}
+	for _, c := range path {
+		if c < 0x20 || c == 0x7f {
+			return unsafe("control character")
+		}
+	}
+	if strings.ContainsRune(path, '\\') {
+		return unsafe("backslash in path")
+	}
+	if strings.HasPrefix(path, "/") {
+		return unsafe("absolute path")
+	}
+	for _, part := range strings.Split(path, "/") {
+		switch {
+		case part == "":
+			return unsafe("empty path component")
+		case part == "." || part == "..":
+			return unsafe("relative path component")
+		case strings.ContainsRune(part, ':'):
+			return unsafe("drive letter or stream name")
+		case strings.HasSuffix(part, ".") || strings.HasSuffix(part, " "):
+			// Windows silently strips them.
+			return unsafe("trailing dot or space")
+		}
+		base := strings.ToUpper(strings.SplitN(part, ".", 2)[0])
+		if reservedNames[base] {
+			return unsafe("reserved Windows name")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+// queue.go - reporting position in server wait queue
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// QueueKeepAlive is the longest interval between queue positions sent to a
+// waiting client. Clients may consider server dead if it's silent for much
+// longer.
+const QueueKeepAlive = 30 * time.Second
+
+// WriteQueuePosition sends client position in the wait queue, 1 for the
+// first one. Position 0 means client is not waiting anymore and the session
+// continues.
+func (e *Encoder) WriteQueuePosition(pos uint32) error {
+	return binary.Write(e.w, binary.LittleEndian, pos)
+}
+
+// ReadQueuePosition receives client position in the wait queue.
+func (d *Decoder) ReadQueuePosition() (uint32, error) {
+	var pos uint32
+	err := binary.Read(d.r, binary.LittleEndian, &pos)
+	return pos, err
+}
@@ -0,0 +1,68 @@
+// resume.go - messages used to resume interrupted transfers
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// ResumeRequest asks server to send a file starting from Offset, provided
+// that it still serves contents with given Hash.
+type ResumeRequest struct {
+	// Path in wire format (see ToWire).
+	Path   string
+	Hash   Hash
+	Offset uint64
+}
+
+// WriteResumeRequest sends a single resume request.
+func (e *Encoder) WriteResumeRequest(req ResumeRequest) error {
+	err := e.WriteString(ToWire(req.Path))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(req.Hash[:])
+	if err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, req.Offset)
+}
+
+// WriteResumeRequestsEnd sends an empty path which ends the list of resume
+// requests.
+func (e *Encoder) WriteResumeRequestsEnd() error {
+	return e.WriteString("")
+}
+
+// ReadResumeRequest receives a single resume request. end is true if the list
+// of requests is over, req is nil in this case.
+func (d *Decoder) ReadResumeRequest() (req *ResumeRequest, end bool, err error) {
+	path, err := d.readPath()
+	if err != nil {
+		return nil, false, err
+	}
+	if path == "" {
+		return nil, true, nil
+	}
+	req = &ResumeRequest{Path: path}
+	_, err = io.ReadFull(d.r, req.Hash[:])
+	if err != nil {
+		return nil, false, err
+	}
+	err = binary.Read(d.r, binary.LittleEndian, &req.Offset)
+	if err != nil {
+		return nil, false, err
+	}
+	return req, false, nil
+}
@@ -0,0 +1,142 @@
+// selection.go - choosing profile and release channel
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+package ssproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxNameLength limits length of profile, channel and release names.
+const MaxNameLength = 64
+
+// ErrBadName is returned for names which don't satisfy CheckName.
+var ErrBadName = errors.New("ssproto: invalid profile, channel or release name")
+
+// CheckName reports whether name can be used as a profile, channel or release
+// name: it must consist of ASCII letters, digits, '.', '-' and '_', must not
+// start with a dot and must not be longer than MaxNameLength.
+func CheckName(name string) error {
+	if name == "" || len(name) > MaxNameLength || name[0] == '.' {
+		return ErrBadName
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_':
+		default:
+			return ErrBadName
+		}
+	}
+	return nil
+}
+
+// WriteChannelRequest sends name of the channel client wants to be updated
+// from. Empty name requests the default channel.
+func (e *Encoder) WriteChannelRequest(channel string) error {
+	return e.WriteString(channel)
+}
+
+// readName receives profile, channel or release name, which may be empty.
+func (d *Decoder) readName() (string, error) {
+	size, err := d.readLength(MaxNameLength)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", err
+	}
+	if size != 0 && CheckName(string(b)) != nil {
+		return "", ErrBadName
+	}
+	return string(b), nil
+}
+
+// ReadChannelRequest receives name of requested channel.
+func (d *Decoder) ReadChannelRequest() (string, error) {
+	return d.readName()
+}
+
+// WriteProfileRequest sends name of the profile client wants to be updated
+// from. Empty name lets server decide.
+func (e *Encoder) WriteProfileRequest(profile string) error {
+	return e.WriteString(profile)
+}
+
+// ReadProfileRequest receives name of requested profile.
+func (d *Decoder) ReadProfileRequest() (string, error) {
+	return d.readName()
+}
+
+// SelectionStatus is server reply to profile and channel requests.
+type SelectionStatus uint8
+
+const (
+	// SelectionOK means that server is going to serve the client.
+	SelectionOK SelectionStatus = iota
+	// SelectionUnknownChannel means that requested channel doesn't exist
+	// in selected profile.
+	SelectionUnknownChannel
+	// SelectionNoManifest means that CapManifest was negotiated, but
+	// selected files have no release manifest.
+	SelectionNoManifest
+	// SelectionUnknownProfile means that requested profile doesn't exist.
+	SelectionUnknownProfile
+)
+
+// Selection describes files server decided to serve to the client.
+type Selection struct {
+	Status SelectionStatus
+	// Profile name, sent only if CapProfiles was negotiated.
+	Profile string
+	// Release name, sent only if CapChannels was negotiated. It's empty if
+	// files are not a named release.
+	Release string
+}
+
+// WriteSelection sends reply to profile and channel requests. Names are sent
+// only if status is SelectionOK.
+func (e *Encoder) WriteSelection(sel Selection) error {
+	err := binary.Write(e.w, binary.LittleEndian, sel.Status)
+	if err != nil || sel.Status != SelectionOK {
+		return err
+	}
+	if e.caps.Has(CapProfiles) {
+		if err := e.WriteString(sel.Profile); err != nil {
+			return err
+		}
+	}
+	if e.caps.Has(CapChannels) {
+		return e.WriteString(sel.Release)
+	}
+	return nil
+}
+
+// ReadSelection receives reply to profile and channel requests.
+func (d *Decoder) ReadSelection() (sel Selection, err error) {
+	err = binary.Read(d.r, binary.LittleEndian, &sel.Status)
+	if err != nil || sel.Status != SelectionOK {
+		return sel, err
+	}
+	if d.caps.Has(CapProfiles) {
+		if sel.Profile, err = d.readName(); err != nil {
+			return sel, err
+		}
+	}
+	if d.caps.Has(CapChannels) {
+		sel.Release, err = d.readName()
+	}
+	return sel, err
+}
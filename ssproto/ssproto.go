@@ -0,0 +1,137 @@
+// ssproto.go - SSProto wire format shared by clients and servers
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// Package ssproto implements binary encoding of SSProto messages as described
+// in PROTOCOL.md. It doesn't know anything about sessions or files on disk,
+// it only reads and writes individual protocol elements.
+package ssproto
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Version is a protocol version. Used to determine if clients need update.
+const Version uint8 = 3
+
+// VersionLegacy is the last protocol version without capability negotiation.
+// Servers keep serving such clients, clients fall back to it when connected
+// to older servers.
+const VersionLegacy uint8 = 2
+
+// Port is a default TCP port used by SSProto servers.
+const Port = 48879
+
+// MaxPathLength limits length of paths received from the other side so a
+// broken peer can't make us allocate arbitrary amount of memory.
+const MaxPathLength = 4096
+
+// MaxBlobLength limits length of dynamic-length blobs (like HWInfo) for
+// the same reason.
+const MaxBlobLength = 1 << 20
+
+// MaxVerdicts limits number of verdicts in a batched reply to hash-list.
+const MaxVerdicts = 1 << 24
+
+// ErrBadOffset is returned when peer asks for or sends contents starting past
+// the end of file.
+var ErrBadOffset = errors.New("ssproto: offset is past the end of file")
+
+// ErrTooLong is returned when peer announces a dynamic-length value that
+// exceeds corresponding limit.
+var ErrTooLong = errors.New("ssproto: dynamic-length value is too long")
+
+// HashSize is a size of BLAKE2b-256 hash in bytes.
+const HashSize = 32
+
+// Hash is a 256-bit BLAKE2b hash of file contents.
+type Hash [HashSize]byte
+
+// IsZero reports whether hash consists only of zero bytes. Such hash is used
+// as a hash-list terminator.
+func (h Hash) IsZero() bool {
+	return h == Hash{}
+}
+
+// UUIDSize is a size of client identifier in bytes.
+const UUIDSize = 32
+
+// UUID is a random client identifier.
+type UUID [UUIDSize]byte
+
+// HashListEntry describes a single file in client-side file tree.
+type HashListEntry struct {
+	Hash Hash
+	// Path in wire format (see ToWire).
+	Path string
+}
+
+// Verdict is a server reply to a hash-list entry.
+type Verdict uint8
+
+const (
+	// VerdictRemove means that server doesn't serve the file and it should be deleted.
+	VerdictRemove Verdict = iota
+	// VerdictKeep means that file is up to date.
+	VerdictKeep
+	// VerdictChanged means that server has another version of the file and
+	// will send it. Used only if CapDelta was negotiated, so client keeps the
+	// file for building a signature instead of deleting it.
+	VerdictChanged
+)
+
+// FileFlags describe encoding of a file blob. Sent since version 3.
+type FileFlags uint8
+
+const (
+	// FlagDelta means that file contents are sent as a sequence of delta
+	// operations (see DeltaOp) instead of raw bytes.
+	FlagDelta FileFlags = 1 << iota
+	// FlagCompressed means that file contents are compressed with DEFLATE.
+	// Never combined with FlagDelta.
+	FlagCompressed
+	// FlagResumed means that contents start at File.Offset, continuing
+	// interrupted transfer. Never combined with FlagDelta.
+	FlagResumed
+)
+
+// File is a file blob sent by server during stage 2.
+type File struct {
+	// Path in wire format (see ToWire).
+	Path  string
+	Flags FileFlags
+	// Size of resulting file.
+	Size uint64
+	// Hash of resulting file. Sent only if CapResume or CapMetadata was
+	// negotiated (see Capabilities.HasFileHash).
+	Hash Hash
+	// Offset contents start at if FlagResumed is set.
+	Offset uint64
+	// Body yields exactly Size-Offset bytes of file contents, decompressed if
+	// needed. It must be consumed before reading next message from the
+	// stream. Body is nil for delta-encoded files, use Decoder.ReadDeltaOp to
+	// read them.
+	Body io.Reader
+}
+
+// ToWire converts OS-specific path into wire format with forward slashes.
+func ToWire(path string) string {
+	return strings.Replace(path, string(filepath.Separator), "/", -1)
+}
+
+// FromWire converts path in wire format into OS-specific form.
+func FromWire(path string) string {
+	return strings.Replace(path, "/", string(filepath.Separator), -1)
+}
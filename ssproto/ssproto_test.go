@@ -0,0 +1,267 @@
+// ssproto_test.go - wire format tests
+// Copyright (c) 2018  Hexawolf
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy of
+// this software and associated documentation files (the "Software"), to deal in
+// the Software without restriction, including without limitation the rights to
+// use, copy, modify, merge, publish, distribute, sublicense, and/or sell copies
+// of the Software, and to permit persons to whom the Software is furnished to do
+// so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+package ssproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// pipe returns encoder and decoder sharing a buffer, both set to version v
+// and capabilities caps.
+func pipe(v uint8, caps Capabilities) (*Encoder, *Decoder, *bytes.Buffer) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetVersion(v)
+	enc.SetCapabilities(caps)
+	dec := NewDecoder(&buf)
+	dec.SetVersion(v)
+	dec.SetCapabilities(caps)
+	return enc, dec, &buf
+}
+
+func TestVersionRoundTrip(t *testing.T) {
+	enc, dec, buf := pipe(VersionLegacy, 0)
+	for _, v := range []uint8{1, VersionLegacy, Version, 255} {
+		if err := enc.WriteVersion(v); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != 1 {
+			t.Fatalf("version takes %d bytes, want 1", buf.Len())
+		}
+		got, err := dec.ReadVersion()
+		if err != nil || got != v {
+			t.Errorf("got version %d, %v; want %d", got, err, v)
+		}
+	}
+}
+
+func TestCapabilitiesRoundTrip(t *testing.T) {
+	enc, dec, _ := pipe(Version, 0)
+	caps := CapCompression | CapManifest | CapQueue | 1<<63
+	if err := enc.WriteCapabilities(caps); err != nil {
+		t.Fatal(err)
+	}
+	got, err := dec.ReadCapabilities()
+	if err != nil || got != caps {
+		t.Errorf("got %v, %v; want %v", got, err, caps)
+	}
+}
+
+func TestUUIDRoundTrip(t *testing.T) {
+	enc, dec, buf := pipe(Version, 0)
+	var id UUID
+	for i := range id {
+		id[i] = byte(i + 1)
+	}
+	if err := enc.WriteUUID(id); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), id[:]) {
+		t.Fatalf("UUID is encoded as %x", buf.Bytes())
+	}
+	got, err := dec.ReadUUID()
+	if err != nil || got != id {
+		t.Errorf("got %x, %v; want %x", got, err, id)
+	}
+}
+
+func TestHashListRoundTrip(t *testing.T) {
+	enc, dec, buf := pipe(VersionLegacy, 0)
+	entries := []HashListEntry{
+		{Hash: Hash{1}, Path: "mods/a.jar"},
+		{Hash: Hash{31: 0xff}, Path: "config/sub/b.cfg"},
+	}
+	for _, e := range entries {
+		if err := enc.WriteHashListEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteTerminator(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hash, then path length and path.
+	first := buf.Bytes()[:HashSize+8+len(entries[0].Path)]
+	var want bytes.Buffer
+	want.Write(entries[0].Hash[:])
+	binary.Write(&want, binary.LittleEndian, uint64(len(entries[0].Path)))
+	want.WriteString(entries[0].Path)
+	if !bytes.Equal(first, want.Bytes()) {
+		t.Errorf("entry is encoded as %x, want %x", first, want.Bytes())
+	}
+
+	for _, e := range entries {
+		got, end, err := dec.ReadHashListEntry()
+		if err != nil || end || got != e {
+			t.Errorf("got %+v, %v, %v; want %+v", got, end, err, e)
+		}
+	}
+	if _, end, err := dec.ReadHashListEntry(); err != nil || !end {
+		t.Errorf("terminator: got end %v, %v", end, err)
+	}
+}
+
+func TestVerdictsRoundTrip(t *testing.T) {
+	enc, dec, _ := pipe(Version, CapBatchVerdicts)
+	verdicts := []Verdict{VerdictKeep, VerdictRemove, VerdictChanged}
+	if err := enc.WriteVerdict(VerdictChanged); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.WriteVerdicts(verdicts); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := dec.ReadVerdict(); err != nil || v != VerdictChanged {
+		t.Errorf("got %v, %v; want %v", v, err, VerdictChanged)
+	}
+	got, err := dec.ReadVerdicts()
+	if err != nil || len(got) != len(verdicts) {
+		t.Fatalf("got %v, %v; want %v", got, err, verdicts)
+	}
+	for i := range got {
+		if got[i] != verdicts[i] {
+			t.Errorf("verdict %d is %v, want %v", i, got[i], verdicts[i])
+		}
+	}
+}
+
+// readBody reads contents of received file and checks them.
+func readBody(t *testing.T, f *File, want string) {
+	t.Helper()
+	got, err := ioutil.ReadAll(f.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s: got contents %q, want %q", f.Path, got, want)
+	}
+}
+
+func TestLegacyFileFraming(t *testing.T) {
+	enc, dec, buf := pipe(VersionLegacy, 0)
+	body := "contents"
+	err := enc.WriteFile(File{Path: "mods/a.jar", Size: uint64(len(body)), Body: strings.NewReader(body)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No flags and no hash before version 3.
+	var want bytes.Buffer
+	binary.Write(&want, binary.LittleEndian, uint64(len("mods/a.jar")))
+	want.WriteString("mods/a.jar")
+	binary.Write(&want, binary.LittleEndian, uint64(len(body)))
+	want.WriteString(body)
+	if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+		t.Fatalf("file is encoded as %x, want %x", buf.Bytes(), want.Bytes())
+	}
+
+	// There is no end marker, the stream is just closed.
+	if err := enc.WriteFilesEnd(); err != nil {
+		t.Fatal(err)
+	}
+	f, end, err := dec.ReadFile()
+	if err != nil || end {
+		t.Fatalf("got end %v, %v", end, err)
+	}
+	readBody(t, f, body)
+	if _, _, err := dec.ReadFile(); err != io.EOF {
+		t.Errorf("after last file got %v, want io.EOF", err)
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	enc, dec, _ := pipe(Version, CapCompression|CapMetadata|CapResume)
+	plain := "plain contents"
+	compressible := strings.Repeat("compress me ", 1000)
+	files := []File{
+		{Path: "mods/a.jar", Size: uint64(len(plain)), Hash: Hash{1}},
+		{Path: "config/b.cfg", Flags: FlagCompressed, Size: uint64(len(compressible)), Hash: Hash{2}},
+		{Path: "mods/c.jar", Flags: FlagResumed, Size: uint64(len(plain)), Hash: Hash{3}, Offset: 6},
+	}
+	contents := []string{plain, compressible, plain[6:]}
+	for i, f := range files {
+		f.Body = strings.NewReader(contents[i])
+		if err := enc.WriteFile(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.WriteFilesEnd(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range files {
+		f, end, err := dec.ReadFile()
+		if err != nil || end {
+			t.Fatalf("got end %v, %v", end, err)
+		}
+		if f.Path != want.Path || f.Flags != want.Flags || f.Size != want.Size ||
+			f.Hash != want.Hash || f.Offset != want.Offset {
+			t.Errorf("got %+v, want %+v", f, want)
+		}
+		readBody(t, f, contents[i])
+	}
+	f, end, err := dec.ReadFile()
+	if err != nil || !end || f != nil {
+		t.Errorf("end marker: got %+v, %v, %v", f, end, err)
+	}
+}
+
+func TestReadFileRejectsUnsafePath(t *testing.T) {
+	enc, dec, _ := pipe(Version, 0)
+	if err := enc.WriteFileHeader(File{Path: "../evil.jar"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := dec.ReadFile(); err == nil {
+		t.Error("unsafe path accepted")
+	} else if _, ok := err.(ErrUnsafePath); !ok {
+		t.Errorf("got %v, want ErrUnsafePath", err)
+	}
+}
+
+func TestReadBlobTooLong(t *testing.T) {
+	enc, dec, _ := pipe(Version, 0)
+	if err := enc.WriteBlob([]byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := dec.ReadBlob(); err != nil || string(b) != "short" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint64(MaxBlobLength+1))
+	if _, err := NewDecoder(&buf).ReadBlob(); err != ErrTooLong {
+		t.Errorf("got %v, want ErrTooLong", err)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	safe := []string{"mods/a.jar", "config/sub/b.cfg", ".minecraft/options.txt", "a..b"}
+	for _, p := range safe {
+		if err := CheckPath(p); err != nil {
+			t.Errorf("%q rejected: %v", p, err)
+		}
+	}
+	unsafe := []string{
+		"", "/etc/passwd", "../a", "mods/../../a", "./mods", "mods/", "mods//a",
+		".", `mods\a`, "C:/a", "mods/a.jar:stream", "mods/a.", "mods/a ",
+		"CON", "mods/nul.txt", "mods/a\x00b", "mods/\x7f",
+	}
+	for _, p := range unsafe {
+		if err := CheckPath(p); err == nil {
+			t.Errorf("%q accepted", p)
+		}
+	}
+}